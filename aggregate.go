@@ -0,0 +1,237 @@
+package dbdt
+
+import (
+	"fmt"
+	"reflect"
+)
+
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 |
+		~float32 | ~float64
+}
+
+func getColumnField(targetType reflect.Type, column string) (reflect.StructField, error) {
+	for _, field := range getExportedFields(targetType) {
+		if field.Name == column {
+			return field, nil
+		}
+	}
+
+	return reflect.StructField{}, fmt.Errorf("unknown column %s for table %s", column, GetTableName(targetType))
+}
+
+// Soft-deleted rows are excluded unless options include WithDeleted
+func whereClause(targetType reflect.Type, where string, options queryOptions) string {
+	notDeleted := notDeletedCondition(targetType, options, "")
+
+	switch {
+	case where == "" && notDeleted == "":
+		return ""
+	case where == "":
+		return " WHERE " + notDeleted
+	case notDeleted == "":
+		return " WHERE " + where
+	}
+
+	return " WHERE (" + where + ") AND " + notDeleted
+}
+
+func toNumber[N Number](value any) (N, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil // Aggregates over no rows return NULL
+	case int64:
+		return N(v), nil
+	case float64:
+		return N(v), nil
+	}
+
+	return 0, fmt.Errorf("cannot convert %T to a number", value)
+}
+
+func Count[T any](where string, args ...any) (int, error) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer db.Close()
+
+	return CountDB[T](db, where, args...)
+}
+
+// Soft-deleted rows are not counted unless WithDeleted() is passed among args
+func CountDB[T any](db DBTX, where string, args ...any) (int, error) {
+	targetType := reflect.TypeFor[T]()
+	tableName := GetTableName(targetType)
+	args, options := splitQueryOptions(args)
+
+	query := "SELECT COUNT(*) FROM \"" + tableName + "\"" + whereClause(targetType, where, options)
+
+	return GetSingleDB[int](db, query, args...)
+}
+
+func Exists[T any](id any, options ...QueryOption) (bool, error) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return false, err
+	}
+
+	defer db.Close()
+
+	return ExistsDB[T](db, id, options...)
+}
+
+// Soft-deleted rows do not exist unless WithDeleted is passed
+func ExistsDB[T any](db DBTX, id any, options ...QueryOption) (bool, error) {
+	targetType := reflect.TypeFor[T]()
+	tableName := GetTableName(targetType)
+
+	query := "SELECT EXISTS (SELECT 1 FROM \"" + tableName + "\"" + whereClause(targetType, "ID = ?", applyQueryOptions(options)) + ")"
+
+	return GetSingleDB[bool](db, query, id)
+}
+
+// Soft-deleted rows are left out unless WithDeleted() is passed among args
+func aggregateDB[T any, N Number](db DBTX, function string, column string, where string, args ...any) (N, error) {
+	targetType := reflect.TypeFor[T]()
+	tableName := GetTableName(targetType)
+	args, options := splitQueryOptions(args)
+
+	_, err := getColumnField(targetType, column)
+
+	if err != nil {
+		return 0, err
+	}
+
+	query := fmt.Sprintf("SELECT %s(%s) FROM \"%s\"%s", function, column, tableName, whereClause(targetType, where, options))
+
+	value, err := GetSingleDB[any](db, query, args...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return toNumber[N](value)
+}
+
+func Sum[T any, N Number](column string, where string, args ...any) (N, error) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer db.Close()
+
+	return SumDB[T, N](db, column, where, args...)
+}
+
+func SumDB[T any, N Number](db DBTX, column string, where string, args ...any) (N, error) {
+	return aggregateDB[T, N](db, "SUM", column, where, args...)
+}
+
+func Min[T any, N Number](column string, where string, args ...any) (N, error) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer db.Close()
+
+	return MinDB[T, N](db, column, where, args...)
+}
+
+func MinDB[T any, N Number](db DBTX, column string, where string, args ...any) (N, error) {
+	return aggregateDB[T, N](db, "MIN", column, where, args...)
+}
+
+func Max[T any, N Number](column string, where string, args ...any) (N, error) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer db.Close()
+
+	return MaxDB[T, N](db, column, where, args...)
+}
+
+func MaxDB[T any, N Number](db DBTX, column string, where string, args ...any) (N, error) {
+	return aggregateDB[T, N](db, "MAX", column, where, args...)
+}
+
+func Avg[T any, N Number](column string, where string, args ...any) (N, error) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer db.Close()
+
+	return AvgDB[T, N](db, column, where, args...)
+}
+
+func AvgDB[T any, N Number](db DBTX, column string, where string, args ...any) (N, error) {
+	return aggregateDB[T, N](db, "AVG", column, where, args...)
+}
+
+func GroupCount[T any](column string, options ...QueryOption) (map[any]int, error) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer db.Close()
+
+	return GroupCountDB[T](db, column, options...)
+}
+
+// Keys are the stored column values, BLOBs are converted to strings so they can be used as map keys.
+// Soft-deleted rows are not counted unless WithDeleted is passed.
+func GroupCountDB[T any](db DBTX, column string, options ...QueryOption) (map[any]int, error) {
+	targetType := reflect.TypeFor[T]()
+	tableName := GetTableName(targetType)
+
+	_, err := getColumnField(targetType, column)
+
+	if err != nil {
+		return nil, err
+	}
+
+	where := whereClause(targetType, "", applyQueryOptions(options))
+	query := fmt.Sprintf("SELECT %s, COUNT(*) FROM \"%s\"%s GROUP BY %s", column, tableName, where, column)
+
+	grid, err := GetGridDB(db, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[any]int{}
+
+	for _, row := range grid.Rows {
+		key := row[0]
+
+		if bytes, ok := key.([]byte); ok {
+			key = string(bytes)
+		}
+
+		count, err := toNumber[int](row[1])
+
+		if err != nil {
+			return nil, err
+		}
+
+		counts[key] = count
+	}
+
+	return counts, nil
+}
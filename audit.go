@@ -0,0 +1,199 @@
+package dbdt
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// Zero times are stored as NULL, so unset timestamps read back as the zero time
+func columnValue(value reflect.Value) any {
+	if value.Type() == timeType {
+		timestamp := value.Interface().(time.Time)
+
+		if timestamp.IsZero() {
+			return nil
+		}
+
+		return timestamp
+	}
+
+	return value.Interface()
+}
+
+// Fields tagged `db:",created"`, `db:",updated"` and `db:",deleted"`
+type auditFields struct {
+	created    reflect.StructField
+	updated    reflect.StructField
+	deleted    reflect.StructField
+	hasCreated bool
+	hasUpdated bool
+	hasDeleted bool
+}
+
+func getAuditFields(fields []reflect.StructField) (auditFields, error) {
+	audit := auditFields{}
+
+	audit.created, audit.hasCreated = getTaggedField(fields, "created")
+	audit.updated, audit.hasUpdated = getTaggedField(fields, "updated")
+	audit.deleted, audit.hasDeleted = getTaggedField(fields, "deleted")
+
+	for _, field := range []reflect.StructField{audit.created, audit.updated, audit.deleted} {
+		if field.Name != "" && field.Type != timeType {
+			return audit, fmt.Errorf("timestamp field %s must be a time.Time", field.Name)
+		}
+	}
+
+	return audit, nil
+}
+
+func (audit auditFields) isCreated(field reflect.StructField) bool {
+	return audit.hasCreated && field.Name == audit.created.Name
+}
+
+func (audit auditFields) isDeleted(field reflect.StructField) bool {
+	return audit.hasDeleted && field.Name == audit.deleted.Name
+}
+
+// Sets the created time (unless already set) and the updated time on an entity about to be inserted
+func stampInsert(entityValues reflect.Value, fields []reflect.StructField) error {
+	audit, err := getAuditFields(fields)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	if audit.hasCreated {
+		created := entityValues.FieldByIndex(audit.created.Index)
+
+		if created.Interface().(time.Time).IsZero() {
+			created.Set(reflect.ValueOf(now))
+		}
+	}
+
+	if audit.hasUpdated {
+		entityValues.FieldByIndex(audit.updated.Index).Set(reflect.ValueOf(now))
+	}
+
+	return nil
+}
+
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	withDeleted bool
+}
+
+// Includes soft-deleted rows in the results
+func WithDeleted() QueryOption {
+	return func(options *queryOptions) {
+		options.withDeleted = true
+	}
+}
+
+func applyQueryOptions(options []QueryOption) queryOptions {
+	applied := queryOptions{}
+
+	for _, option := range options {
+		option(&applied)
+	}
+
+	return applied
+}
+
+// FindAll style functions take query args, so options are picked out of them
+func splitQueryOptions(args []any) ([]any, queryOptions) {
+	queryArgs := []any{}
+	options := []QueryOption{}
+
+	for _, arg := range args {
+		if option, ok := arg.(QueryOption); ok {
+			options = append(options, option)
+			continue
+		}
+
+		queryArgs = append(queryArgs, arg)
+	}
+
+	return queryArgs, applyQueryOptions(options)
+}
+
+func notDeletedCondition(targetType reflect.Type, options queryOptions, prefix string) string {
+	if options.withDeleted {
+		return ""
+	}
+
+	audit, err := getAuditFields(getExportedFields(targetType))
+
+	if err != nil || !audit.hasDeleted {
+		return ""
+	}
+
+	return prefix + audit.deleted.Name + " IS NULL"
+}
+
+func excludeDeleted[T any](entities []T) ([]T, error) {
+	audit, err := getAuditFields(getExportedFields(reflect.TypeFor[T]()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !audit.hasDeleted {
+		return entities, nil
+	}
+
+	remaining := []T{}
+
+	for _, entity := range entities {
+		deleted := reflect.ValueOf(entity).FieldByIndex(audit.deleted.Index).Interface().(time.Time)
+
+		if deleted.IsZero() {
+			remaining = append(remaining, entity)
+		}
+	}
+
+	return remaining, nil
+}
+
+func Delete[T any](id any) error {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	return DeleteDB[T](db, id)
+}
+
+// If T has a `db:",deleted"` field the row is kept and marked as deleted instead
+func DeleteDB[T any](db DBTX, id any) error {
+	targetType := reflect.TypeFor[T]()
+	tableName := GetTableName(targetType)
+
+	audit, err := getAuditFields(getExportedFields(targetType))
+
+	if err != nil {
+		return err
+	}
+
+	if !audit.hasDeleted {
+		return ExecDB(db, "DELETE FROM \""+tableName+"\" WHERE ID = ?;", id)
+	}
+
+	query := "UPDATE \"" + tableName + "\" SET " + audit.deleted.Name + " = ?1"
+
+	if audit.hasUpdated {
+		query += ", " + audit.updated.Name + " = ?1"
+	}
+
+	query += " WHERE ID = ?2 AND " + audit.deleted.Name + " IS NULL;"
+
+	return ExecDB(db, query, time.Now().UTC(), id)
+}
@@ -0,0 +1,431 @@
+package dbdt
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Triggers record every row change of tables with the change feed enabled, including writes from other processes.
+// Rows are stored as JSON objects keyed by field name, so they decode straight into the entity type.
+var createChanges = []string{
+	`CREATE TABLE IF NOT EXISTS __dbdt_changes (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		table_name TEXT NOT NULL,
+		row_id INTEGER NOT NULL,
+		op TEXT NOT NULL,
+		old_json TEXT,
+		new_json TEXT,
+		changed_at INTEGER NOT NULL
+	)`,
+	"CREATE INDEX IF NOT EXISTS __dbdt_changes_table ON __dbdt_changes (table_name, seq)",
+	createChangeCheckpoints,
+}
+
+const createChangeCheckpoints = `CREATE TABLE IF NOT EXISTS __dbdt_change_checkpoints (
+	consumer TEXT PRIMARY KEY,
+	seq INTEGER NOT NULL
+)`
+
+type ChangeOp string
+
+const (
+	ChangeInsert ChangeOp = "INSERT"
+	ChangeUpdate ChangeOp = "UPDATE"
+	ChangeDelete ChangeOp = "DELETE"
+)
+
+type Change[T any] struct {
+	Seq       int64
+	Op        ChangeOp
+	Old       T // Zero for inserts
+	New       T // Zero for deletes
+	ChangedAt time.Time
+}
+
+// Byte slices and arrays are stored as BLOBs
+func isBytesField(field reflect.StructField) bool {
+	kind := field.Type.Kind()
+
+	return (kind == reflect.Slice || kind == reflect.Array) && field.Type.Elem().Kind() == reflect.Uint8
+}
+
+// A json_object of the row's fields. Bools are stored as ints and timestamps in SQLite's format,
+// so both are converted to their encoding/json form. JSON cannot hold BLOBs, so they are hex encoded.
+func rowJSON(targetType reflect.Type, row string) string {
+	pairs := []string{}
+
+	for _, field := range getExportedFields(targetType) {
+		column := row + "." + field.Name
+
+		switch {
+		case field.Type.Kind() == reflect.Bool:
+			column = "json(iif(" + column + ", 'true', 'false'))"
+		case field.Type == timeType:
+			column = "replace(" + column + ", ' ', 'T')"
+		case isBytesField(field):
+			column = "iif(" + column + " IS NULL, NULL, hex(" + column + "))"
+		}
+
+		pairs = append(pairs, "'"+field.Name+"', "+column)
+	}
+
+	return "json_object(" + strings.Join(pairs, ", ") + ")"
+}
+
+func changeTriggerName(tableName string, op ChangeOp) string {
+	return "\"__dbdt_changes_" + tableName + "_" + strings.ToLower(string(op)) + "\""
+}
+
+func changeTrigger(targetType reflect.Type, op ChangeOp) string {
+	tableName := GetTableName(targetType)
+	row, old, new := "NEW", "NULL", rowJSON(targetType, "NEW")
+
+	switch op {
+	case ChangeUpdate:
+		old = rowJSON(targetType, "OLD")
+	case ChangeDelete:
+		row, old, new = "OLD", rowJSON(targetType, "OLD"), "NULL"
+	}
+
+	return fmt.Sprintf(`CREATE TRIGGER %s AFTER %s ON "%s"
+		BEGIN
+			INSERT INTO __dbdt_changes (table_name, row_id, op, old_json, new_json, changed_at)
+			VALUES ('%s', %s.ID, '%s', %s, %s, CAST(unixepoch('subsec') * 1000000000 AS INTEGER));
+		END`,
+		changeTriggerName(tableName, op), op, tableName,
+		tableName, row, op, old, new)
+}
+
+func EnableChangeFeed[T any]() error {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	return EnableChangeFeedDB[T](db)
+}
+
+// Starts recording changes to T's table. The triggers are recreated, so call this again after adding fields to T.
+func EnableChangeFeedDB[T any](db DBTX) error {
+	targetType := reflect.TypeFor[T]()
+	tableName := GetTableName(targetType)
+
+	if !identifierPattern.MatchString(tableName) {
+		return fmt.Errorf("cannot record changes to table %q", tableName)
+	}
+
+	transaction, err := begin(db)
+
+	if err != nil {
+		return err
+	}
+
+	queries := slices.Clone(createChanges)
+
+	for _, op := range []ChangeOp{ChangeInsert, ChangeUpdate, ChangeDelete} {
+		queries = append(queries, "DROP TRIGGER IF EXISTS "+changeTriggerName(tableName, op), changeTrigger(targetType, op))
+	}
+
+	for _, query := range queries {
+		_, err = transaction.Exec(query)
+
+		if err != nil {
+			transaction.Rollback()
+			return err
+		}
+	}
+
+	return transaction.Commit()
+}
+
+func DisableChangeFeed[T any]() error {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	return DisableChangeFeedDB[T](db)
+}
+
+// Stops recording changes to T's table, changes already recorded are kept
+func DisableChangeFeedDB[T any](db DBTX) error {
+	tableName := GetTableName(reflect.TypeFor[T]())
+
+	for _, op := range []ChangeOp{ChangeInsert, ChangeUpdate, ChangeDelete} {
+		err := ExecDB(db, "DROP TRIGGER IF EXISTS "+changeTriggerName(tableName, op))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const changesPageSize = 256
+
+// Iterates over changes to T's table recorded after sinceSeq, oldest first. The active database is opened
+// for each page of changes, and changes recorded while iterating are included.
+func Changes[T any](sinceSeq int64) iter.Seq2[Change[T], error] {
+	return changes[T](func() (DBTX, func(), error) {
+		db, err := OpenActiveDB()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return db, func() { db.Close() }, nil
+	}, sinceSeq)
+}
+
+func ChangesDB[T any](db DBTX, sinceSeq int64) iter.Seq2[Change[T], error] {
+	return changes[T](func() (DBTX, func(), error) {
+		return db, func() {}, nil
+	}, sinceSeq)
+}
+
+func changes[T any](open func() (DBTX, func(), error), sinceSeq int64) iter.Seq2[Change[T], error] {
+	return paged(changesPageSize, func(last *Change[T]) ([]Change[T], error) {
+		if last == nil {
+			return changesPage[T](open, sinceSeq)
+		}
+
+		return changesPage[T](open, last.Seq)
+	})
+}
+
+func changesPage[T any](open func() (DBTX, func(), error), sinceSeq int64) ([]Change[T], error) {
+	db, release, err := open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	query := `SELECT seq, op, old_json, new_json, changed_at FROM __dbdt_changes
+		WHERE table_name = ? AND seq > ? ORDER BY seq LIMIT ?`
+
+	rows, err := db.Query(query, GetTableName(reflect.TypeFor[T]()), sinceSeq, changesPageSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	page := []Change[T]{}
+
+	for rows.Next() {
+		change := Change[T]{}
+		old, new := sql.NullString{}, sql.NullString{}
+		changedAt := int64(0)
+
+		err = rows.Scan(&change.Seq, &change.Op, &old, &new, &changedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		change.ChangedAt = time.Unix(0, changedAt)
+
+		if old.Valid {
+			err = decodeRowJSON(old.String, &change.Old)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if new.Valid {
+			err = decodeRowJSON(new.String, &change.New)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		page = append(page, change)
+	}
+
+	return page, rows.Err()
+}
+
+// Fields are set one at a time, so json tags on the entity do not affect decoding
+func decodeRowJSON[T any](data string, entity *T) error {
+	values := map[string]json.RawMessage{}
+
+	err := json.Unmarshal([]byte(data), &values)
+
+	if err != nil {
+		return err
+	}
+
+	target := reflect.ValueOf(entity).Elem()
+
+	for name, value := range values {
+		field := target.FieldByName(name)
+
+		if !field.IsValid() || !field.CanSet() {
+			continue
+		}
+
+		structField, _ := target.Type().FieldByName(name)
+
+		if isBytesField(structField) {
+			err = decodeHexField(value, field)
+		} else {
+			err = json.Unmarshal(value, field.Addr().Interface())
+		}
+
+		if err != nil {
+			return fmt.Errorf("cannot decode %s, %w", name, err)
+		}
+	}
+
+	return callAfterLoad(entity)
+}
+
+// BLOBs are recorded as hex strings, NULL leaves the field unset
+func decodeHexField(value json.RawMessage, field reflect.Value) error {
+	encoded := (*string)(nil)
+
+	err := json.Unmarshal(value, &encoded)
+
+	if err != nil || encoded == nil {
+		return err
+	}
+
+	decoded, err := hex.DecodeString(*encoded)
+
+	if err != nil {
+		return err
+	}
+
+	if field.Kind() == reflect.Array {
+		reflect.Copy(field, reflect.ValueOf(decoded))
+	} else {
+		field.SetBytes(decoded)
+	}
+
+	return nil
+}
+
+// Calls fn with each change to T's table after sinceSeq. Changes already recorded are delivered before this returns,
+// later ones on the watcher's goroutine as they happen. Errors reading changes are reported like the watcher's own, see Errors.
+func SubscribeChanges[T any](watcher *DBWatcher, sinceSeq int64, fn func(Change[T])) (unsubscribe func(), err error) {
+	lock := sync.Mutex{}
+	last := sinceSeq
+
+	catchUp := func() {
+		lock.Lock()
+		defer lock.Unlock()
+
+		for change, err := range ChangesDB[T](watcher.db, last) {
+			if err != nil {
+				watcher.reportError(fmt.Errorf("could not read changes to %s, %w", GetTableName(reflect.TypeFor[T]()), err))
+				return
+			}
+
+			fn(change)
+			last = change.Seq
+		}
+	}
+
+	unsubscribe, err = WatchTable[T](watcher, catchUp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	catchUp()
+
+	return unsubscribe, nil
+}
+
+func SaveChangeCheckpoint(consumer string, seq int64) error {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	return SaveChangeCheckpointDB(db, consumer, seq)
+}
+
+// Records how far consumer has read, so it can resume from LoadChangeCheckpoint after a restart
+func SaveChangeCheckpointDB(db DBTX, consumer string, seq int64) error {
+	err := ExecDB(db, createChangeCheckpoints)
+
+	if err != nil {
+		return err
+	}
+
+	query := "INSERT OR REPLACE INTO __dbdt_change_checkpoints (consumer, seq) VALUES (?, ?)"
+
+	return ExecDB(db, query, consumer, seq)
+}
+
+func LoadChangeCheckpoint(consumer string) (int64, error) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer db.Close()
+
+	return LoadChangeCheckpointDB(db, consumer)
+}
+
+// The last saved seq for consumer, 0 if it has none
+func LoadChangeCheckpointDB(db DBTX, consumer string) (int64, error) {
+	exists, err := GetSingleDB[bool](db, "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = '__dbdt_change_checkpoints')")
+
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	query := "SELECT COALESCE(MAX(seq), 0) FROM __dbdt_change_checkpoints WHERE consumer = ?"
+
+	return GetSingleDB[int64](db, query, consumer)
+}
+
+func PruneChanges(throughSeq int64) (int64, error) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer db.Close()
+
+	return PruneChangesDB(db, throughSeq)
+}
+
+// Deletes recorded changes up to and including throughSeq, e.g. the lowest checkpoint. Returns the number deleted.
+func PruneChangesDB(db DBTX, throughSeq int64) (int64, error) {
+	res, err := db.Exec("DELETE FROM __dbdt_changes WHERE seq <= ?", throughSeq)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,221 @@
+package dbdt
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// OpenDB opens connections with this driver, through dbConnector
+var dbDriver = &sqlite3.SQLiteDriver{}
+
+type RowChange struct {
+	Database string // The database file, as reported by SQLite, "" for in-memory databases
+	Table    string
+	Op       ChangeOp
+	RowID    int64
+}
+
+// SQLite's action codes, which go-sqlite3 only defines when built with cgo
+var changeOps = map[int]ChangeOp{
+	18: ChangeInsert,
+	23: ChangeUpdate,
+	9:  ChangeDelete,
+}
+
+const sqliteSavepoint = 32
+
+// A connection's changes. Rows are collected by the update hook, moved to committed by the commit hook and
+// published by dbConn once the call that committed them returns, since the commit can still fail after the hook.
+// Connections are only used by one goroutine at a time, so this needs no lock.
+type connChanges struct {
+	pending    []RowChange
+	savepoints []savepoint
+	committed  [][]RowChange
+}
+
+// Changes made before the savepoint, so ROLLBACK TO can drop those made after it
+type savepoint struct {
+	name    string
+	changes int
+}
+
+func watchCommits(conn *sqlite3.SQLiteConn) *connChanges {
+	changes := &connChanges{}
+
+	conn.RegisterUpdateHook(func(op int, database string, table string, rowID int64) {
+		if commitSubscriberCount.Load() == 0 {
+			return
+		}
+
+		changes.pending = append(changes.pending, RowChange{connFilename(conn, database), table, changeOps[op], rowID})
+	})
+
+	// The authorizer sees each statement as it is prepared, which for savepoints is just before it runs
+	conn.RegisterAuthorizer(func(action int, operation string, name string, _ string) int {
+		if action == sqliteSavepoint {
+			changes.savepoint(operation, name)
+		}
+
+		return 0 // Allow the statement
+	})
+
+	conn.RegisterCommitHook(func() int {
+		if len(changes.pending) > 0 {
+			changes.committed = append(changes.committed, changes.pending)
+		}
+
+		changes.pending = []RowChange{}
+		changes.savepoints = nil
+
+		return 0 // Let the commit go ahead
+	})
+
+	// Also called when a commit fails after the commit hook, go-sqlite3 rolls back failed commits
+	conn.RegisterRollbackHook(func() {
+		changes.pending = []RowChange{}
+		changes.savepoints = nil
+		changes.committed = nil
+	})
+
+	return changes
+}
+
+// Operation is BEGIN, RELEASE or ROLLBACK, as passed to SQLite's authorizer
+func (changes *connChanges) savepoint(operation string, name string) {
+	if operation == "BEGIN" {
+		changes.savepoints = append(changes.savepoints, savepoint{name, len(changes.pending)})
+		return
+	}
+
+	// Names are case-insensitive, and the most recent savepoint with the name is the one used
+	i := len(changes.savepoints) - 1
+
+	for i >= 0 && !strings.EqualFold(changes.savepoints[i].name, name) {
+		i--
+	}
+
+	if i < 0 {
+		return // SQLite fails the statement
+	}
+
+	switch operation {
+	case "ROLLBACK":
+		changes.pending = changes.pending[:changes.savepoints[i].changes]
+		changes.savepoints = changes.savepoints[:i+1] // The savepoint stays open
+	case "RELEASE":
+		changes.savepoints = changes.savepoints[:i]
+	}
+}
+
+// A statement that fails inside a transaction only has its own changes undone, so the rows it reported after
+// mark are dropped. A failure that ends the transaction has already cleared them through the rollback hook.
+func (changes *connChanges) statementFailed(mark int) {
+	if mark < len(changes.pending) {
+		changes.pending = changes.pending[:mark]
+	}
+}
+
+// Publishes the transactions committed by the driver call that just returned
+func (changes *connChanges) publish() {
+	for _, committed := range changes.committed {
+		publishCommit(committed)
+	}
+
+	changes.committed = nil
+}
+
+type commitSubscriber struct {
+	callback     func(changes []RowChange)
+	unsubscribed atomic.Bool
+}
+
+var commitLock sync.Mutex
+var commitSubscribers = []*commitSubscriber{} // Replaced rather than modified, like DBWatcher callbacks
+var commitSubscriberCount atomic.Int32
+var commitQueue = [][]RowChange{}
+var commitDraining = false
+
+// Calls callback with the rows changed by each transaction committed through connections opened by OpenDB in this
+// process, without polling. Callbacks run in commit order on a separate goroutine, once the commit has succeeded.
+// Rows undone by ROLLBACK TO a savepoint are left out. Changes made by other processes or other drivers are not seen,
+// DBWatcher polls for those. As with SQLite's update hook, rows removed by REPLACE conflicts or by deleting every
+// row of a table are not reported.
+func SubscribeCommits(callback func(changes []RowChange)) (unsubscribe func()) {
+	subscriber := &commitSubscriber{callback: callback}
+
+	commitLock.Lock()
+	commitSubscribers = append(slices.Clip(commitSubscribers), subscriber)
+	commitSubscriberCount.Add(1)
+	commitLock.Unlock()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			subscriber.unsubscribed.Store(true)
+
+			commitLock.Lock()
+			defer commitLock.Unlock()
+
+			commitSubscribers = slices.DeleteFunc(slices.Clone(commitSubscribers), func(other *commitSubscriber) bool {
+				return other == subscriber
+			})
+			commitSubscriberCount.Add(-1)
+		})
+	}
+}
+
+// Queues the changes, starting a goroutine to deliver them if one is not already running.
+// The committing connection is still held by database/sql, so subscribers are never called directly.
+func publishCommit(changes []RowChange) {
+	commitLock.Lock()
+	defer commitLock.Unlock()
+
+	commitQueue = append(commitQueue, changes)
+
+	if !commitDraining {
+		commitDraining = true
+		go drainCommits()
+	}
+}
+
+func drainCommits() {
+	for {
+		commitLock.Lock()
+
+		if len(commitQueue) == 0 {
+			commitDraining = false
+			commitLock.Unlock()
+			return
+		}
+
+		changes := commitQueue[0]
+		commitQueue = commitQueue[1:]
+		subscribers := commitSubscribers
+
+		commitLock.Unlock()
+
+		for _, subscriber := range subscribers {
+			if !subscriber.unsubscribed.Load() {
+				deliverCommit(subscriber.callback, changes)
+			}
+		}
+	}
+}
+
+func deliverCommit(callback func(changes []RowChange), changes []RowChange) {
+	defer func() {
+		r := recover()
+
+		if r != nil {
+			log.Printf("Commit subscriber panicked, %v", r)
+		}
+	}()
+
+	callback(changes)
+}
@@ -4,12 +4,13 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"iter"
+	"maps"
 	"path/filepath"
 	"reflect"
 	"slices"
 	"strings"
-
-	_ "github.com/mattn/go-sqlite3"
+	"time"
 )
 
 var activeDB = "./data.db"
@@ -42,11 +43,84 @@ func OpenActiveDB() (*sql.DB, error) {
 	return OpenDB(activeDB)
 }
 
-func OpenDB(dbPath string) (*sql.DB, error) {
-	return sql.Open("sqlite3", dbPath)
+// Options are applied to every connection in the pool, after any set with SetDefaultOpenOptions
+func OpenDB(dbPath string, options ...OpenOption) (*sql.DB, error) {
+	return openDB(dbPath, options)
+}
+
+// Satisfied by *sql.DB and *sql.Tx, so calls to the ...DB functions can share a transaction
+type DBTX interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// A transaction on a *sql.DB, or a savepoint when db is already a transaction
+type dbTransaction struct {
+	DBTX
+	tx        *sql.Tx
+	savepoint bool
+}
+
+// Satisfied by *sql.DB and wrappers around one
+type beginner interface {
+	Begin() (*sql.Tx, error)
+}
+
+// A savepoint is only safe on a single connection, so other DBTXs must be able to begin a transaction
+func begin(db DBTX) (*dbTransaction, error) {
+	switch db := db.(type) {
+	case *sql.Tx, *dbTransaction:
+		_, err := db.Exec("SAVEPOINT dbdt")
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &dbTransaction{db, nil, true}, nil
+	case beginner:
+		tx, err := db.Begin()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &dbTransaction{tx, tx, false}, nil
+	}
+
+	return nil, fmt.Errorf("cannot start a transaction on %T, it is not a *sql.Tx and has no Begin method", db)
+}
+
+func (transaction *dbTransaction) Commit() error {
+	if transaction.savepoint {
+		_, err := transaction.Exec("RELEASE dbdt")
+		return err
+	}
+
+	return transaction.tx.Commit()
+}
+
+func (transaction *dbTransaction) Rollback() error {
+	if transaction.savepoint {
+		_, err := transaction.Exec("ROLLBACK TO dbdt")
+
+		if err != nil {
+			return err
+		}
+
+		_, err = transaction.Exec("RELEASE dbdt")
+		return err
+	}
+
+	return transaction.tx.Rollback()
 }
 
 func getDBAffinity(field reflect.StructField) string {
+	if field.Type == timeType {
+		return "TIMESTAMP" // Declared type the driver parses back into time.Time
+	}
+
 	kind := field.Type.Kind().String()
 
 	if kind == "string" {
@@ -120,6 +194,16 @@ func getExportedFields(targetType reflect.Type) []reflect.StructField {
 			continue
 		}
 
+		// Only tagged times are columns (`db:""` for a plain one). Untagged times were never mapped, and adding them
+		// would break inserts into tables created before timestamps were supported.
+		if field.Type == timeType {
+			if _, tagged := field.Tag.Lookup("db"); tagged {
+				exportedFields = append(exportedFields, field)
+			}
+
+			continue
+		}
+
 		kind := field.Type.Kind()
 
 		if kind == reflect.Array || kind == reflect.Slice {
@@ -140,7 +224,7 @@ func getExportedFields(targetType reflect.Type) []reflect.StructField {
 	return exportedFields
 }
 
-func CreateTableDB[T any](db *sql.DB) error {
+func CreateTableDB[T any](db DBTX) error {
 	targetType := reflect.TypeFor[T]()
 	tableName := GetTableName(targetType)
 	fields := getExportedFields(targetType)
@@ -188,15 +272,28 @@ func Add[T any](entity T) error {
 	return Insert(ptr)
 }
 
-func AddDB[T any](db *sql.DB, entity T) error {
+func AddDB[T any](db DBTX, entity T) error {
 	ptr := &entity
 	return InsertDB(db, ptr)
 }
 
-func InsertDB[T any](db *sql.DB, entity *T) error {
+func InsertDB[T any](db DBTX, entity *T) error {
 	targetType := reflect.TypeOf(*entity)
 	tableName := GetTableName(targetType)
 	fields := getExportedFields(targetType)
+
+	err := callBeforeInsert(entity)
+
+	if err != nil {
+		return err
+	}
+
+	err = stampInsert(reflect.ValueOf(entity).Elem(), fields)
+
+	if err != nil {
+		return err
+	}
+
 	reflectValue := reflect.ValueOf(*entity)
 	entityValues := make([]any, len(fields))
 
@@ -212,7 +309,7 @@ func InsertDB[T any](db *sql.DB, entity *T) error {
 		}
 
 		if field.Name != "ID" {
-			entityValues[i] = reflectValue.FieldByIndex(field.Index).Interface()
+			entityValues[i] = columnValue(reflectValue.FieldByIndex(field.Index))
 		} else {
 			idValue := reflectValue.FieldByIndex(field.Index).Interface()
 
@@ -229,7 +326,51 @@ func InsertDB[T any](db *sql.DB, entity *T) error {
 
 	query += ");"
 
-	res, err := db.Exec(query, entityValues...)
+	if _, ok := any(entity).(AfterInserter); !ok {
+		return execInsert(db, entity, awaitingRowID, query, entityValues...)
+	}
+
+	// A transaction, so that an AfterInsert error can undo the insert
+	transaction, err := begin(db)
+
+	if err != nil {
+		return err
+	}
+
+	// The row is gone after a rollback, so an ID given out by the database is cleared
+	rollback := func(err error) error {
+		transaction.Rollback()
+
+		if awaitingRowID {
+			reflect.ValueOf(entity).Elem().FieldByName("ID").SetInt(0)
+		}
+
+		return err
+	}
+
+	err = execInsert(transaction, entity, awaitingRowID, query, entityValues...)
+
+	if err != nil {
+		return rollback(err)
+	}
+
+	err = callAfterInsert(entity)
+
+	if err != nil {
+		return rollback(err)
+	}
+
+	err = transaction.Commit()
+
+	if err != nil {
+		return rollback(err)
+	}
+
+	return nil
+}
+
+func execInsert[T any](db DBTX, entity *T, awaitingRowID bool, query string, args ...any) error {
+	res, err := db.Exec(query, args...)
 
 	if err != nil {
 		return err
@@ -272,7 +413,7 @@ func InsertAll[T any](entities []*T) error {
 	return InsertAllDB(db, entities)
 }
 
-func InsertAllDB[T any](db *sql.DB, entities []*T) error {
+func InsertAllDB[T any](db DBTX, entities []*T) error {
 	targetType := reflect.TypeFor[T]()
 	tableName := GetTableName(targetType)
 	fields := getExportedFields(targetType)
@@ -299,25 +440,51 @@ func InsertAllDB[T any](db *sql.DB, entities []*T) error {
 
 	query += ");"
 
-	transaction, err := db.Begin()
+	transaction, err := begin(db)
 
 	if err != nil {
 		return err
 	}
 
-	stmt, err := db.Prepare(query)
+	stmt, err := transaction.Prepare(query)
 
 	if err != nil {
+		transaction.Rollback()
 		return err
 	}
 
 	defer stmt.Close()
 
+	// IDs given out by the database are cleared if the batch is rolled back, so a retry inserts fresh rows
+	assignedIDs := []reflect.Value{}
+
+	rollback := func(err error) error {
+		transaction.Rollback()
+
+		for _, idField := range assignedIDs {
+			idField.SetInt(0)
+		}
+
+		return err
+	}
+
 	for _, entityPtr := range entities {
 		entityValues := reflect.ValueOf(entityPtr).Elem() // Since ValueOf is targeting a pointer, use Elem to get/set underlying struct
 		parameters := make([]any, len(fields))
 		awaitingRowID := useRowID
 
+		err := callBeforeInsert(entityPtr)
+
+		if err != nil {
+			return rollback(err)
+		}
+
+		err = stampInsert(entityValues, fields)
+
+		if err != nil {
+			return rollback(err)
+		}
+
 		if useRowID {
 			// Check if ID is currently 0, if so, send nil
 			idValue := entityValues.FieldByIndex(idFieldIndex).Interface()
@@ -335,28 +502,192 @@ func InsertAllDB[T any](db *sql.DB, entities []*T) error {
 				continue
 			}
 
-			parameters[i] = entityValues.FieldByIndex(field.Index).Interface()
+			parameters[i] = columnValue(entityValues.FieldByIndex(field.Index))
 		}
 
 		res, err := stmt.Exec(parameters...)
 
 		if err != nil {
-			return err
+			return rollback(err)
 		}
 
 		if awaitingRowID {
 			entityID, err := res.LastInsertId()
 
 			if err != nil {
-				return err
+				return rollback(err)
 			}
 
 			idField := entityValues.FieldByIndex(idFieldIndex)
 			idField.SetInt(entityID)
+			assignedIDs = append(assignedIDs, idField)
+		}
+
+		err = callAfterInsert(entityPtr)
+
+		if err != nil {
+			return rollback(err)
+		}
+	}
+
+	err = transaction.Commit()
+
+	if err != nil {
+		return rollback(err)
+	}
+
+	return nil
+}
+
+var ErrStaleVersion = errors.New("stale version, entity was changed by another writer")
+
+// Options come after the comma in a `db:",option"` tag, the name part is reserved since columns are named after fields
+func getTagOptions(field reflect.StructField) []string {
+	tag, ok := field.Tag.Lookup("db")
+
+	if !ok {
+		return nil
+	}
+
+	return strings.Split(tag, ",")[1:]
+}
+
+func getTaggedField(fields []reflect.StructField, option string) (reflect.StructField, bool) {
+	for _, field := range fields {
+		if slices.Contains(getTagOptions(field), option) {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+func getVersionField(fields []reflect.StructField) (reflect.StructField, bool, error) {
+	field, ok := getTaggedField(fields, "version")
+
+	if !ok {
+		return field, false, nil
+	}
+
+	if !strings.HasPrefix(field.Type.Kind().String(), "int") {
+		return field, false, fmt.Errorf("version field %s must be an integer", field.Name)
+	}
+
+	return field, true, nil
+}
+
+// The SET columns, followed by ID and then the version (if any) in the WHERE clause
+type updateStatement struct {
+	query        string
+	fields       []reflect.StructField
+	idField      reflect.StructField
+	versionField reflect.StructField
+	versioned    bool
+	updatedField reflect.StructField
+	timestamped  bool
+}
+
+func buildUpdateStatement(targetType reflect.Type) (updateStatement, error) {
+	tableName := GetTableName(targetType)
+	fields := getExportedFields(targetType)
+
+	statement := updateStatement{}
+
+	idField, err := getColumnField(targetType, "ID")
+
+	if err != nil {
+		return statement, errors.New("cannot update entity, no ID column")
+	}
+
+	versionField, versioned, err := getVersionField(fields)
+
+	if err != nil {
+		return statement, err
+	}
+
+	auditFields, err := getAuditFields(fields)
+
+	if err != nil {
+		return statement, err
+	}
+
+	statement.idField = idField
+	statement.versionField = versionField
+	statement.versioned = versioned
+	statement.updatedField = auditFields.updated
+	statement.timestamped = auditFields.hasUpdated
+
+	assignments := []string{}
+
+	for _, field := range fields {
+		if field.Name == "ID" {
+			continue
+		}
+
+		// Creation time is fixed, and deletion only changes through DeleteDB
+		if auditFields.isCreated(field) || auditFields.isDeleted(field) {
+			continue
+		}
+
+		if versioned && field.Name == versionField.Name {
+			assignments = append(assignments, field.Name+" = "+field.Name+" + 1")
+			continue
 		}
+
+		assignments = append(assignments, field.Name+" = ?")
+		statement.fields = append(statement.fields, field)
 	}
 
-	return transaction.Commit()
+	if len(assignments) == 0 {
+		return statement, errors.New("cannot update entity, no columns to update")
+	}
+
+	statement.query = "UPDATE \"" + tableName + "\" SET " + strings.Join(assignments, ", ") + " WHERE ID = ?"
+
+	if versioned {
+		statement.query += " AND " + versionField.Name + " = ?"
+	}
+
+	statement.query += ";"
+
+	return statement, nil
+}
+
+func (statement updateStatement) stamp(entityValues reflect.Value, now time.Time) {
+	if statement.timestamped {
+		entityValues.FieldByIndex(statement.updatedField.Index).Set(reflect.ValueOf(now))
+	}
+}
+
+func (statement updateStatement) parameters(entityValues reflect.Value) []any {
+	parameters := []any{}
+
+	for _, field := range statement.fields {
+		parameters = append(parameters, columnValue(entityValues.FieldByIndex(field.Index)))
+	}
+
+	parameters = append(parameters, entityValues.FieldByIndex(statement.idField.Index).Interface())
+
+	if statement.versioned {
+		parameters = append(parameters, entityValues.FieldByIndex(statement.versionField.Index).Interface())
+	}
+
+	return parameters
+}
+
+// A versioned update that matched no rows lost the race to another writer, or the row was deleted
+func checkVersionedUpdate(res sql.Result) error {
+	affected, err := res.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrStaleVersion
+	}
+
+	return nil
 }
 
 func Update[T any](entity T) error {
@@ -371,117 +702,282 @@ func Update[T any](entity T) error {
 	return UpdateDB(db, entity)
 }
 
-func UpdateDB[T any](db *sql.DB, entity T) error {
-	targetType := reflect.TypeFor[T]()
-	tableName := GetTableName(targetType)
-	fields := getExportedFields(targetType)
-	entityValues := reflect.ValueOf(entity)
-	parameters := []any{}
+// If T has a `db:",version"` field, the update only applies when the stored version matches, and increments it.
+// Since entity is a copy, reload it (or increment the field) before updating it again.
+func UpdateDB[T any](db DBTX, entity T) error {
+	statement, err := buildUpdateStatement(reflect.TypeFor[T]())
+
+	if err != nil {
+		return err
+	}
 
-	var entityID any
+	err = callBeforeUpdate(&entity)
 
-	query := "UPDATE " + tableName + " SET "
+	if err != nil {
+		return err
+	}
 
-	for i, field := range fields {
-		if field.Name != "ID" {
-			query += field.Name + " = ?"
+	entityValues := reflect.ValueOf(&entity).Elem()
+	statement.stamp(entityValues, time.Now().UTC())
 
-			if i != len(fields)-1 {
-				query += ", "
-			}
+	res, err := db.Exec(statement.query, statement.parameters(entityValues)...)
 
-			value := entityValues.FieldByIndex(field.Index).Interface()
-			parameters = append(parameters, value)
-		} else {
-			entityID = entityValues.FieldByIndex(field.Index).Interface()
+	if err != nil {
+		return err
+	}
+
+	if statement.versioned {
+		return checkVersionedUpdate(res)
+	}
+
+	return nil
+}
+
+// Updates every entity in one transaction, versions are checked as in UpdateDB.
+// On success the slice holds the entities as written, with versions incremented.
+func UpdateAll[T any](db DBTX, entities []T) error {
+	statement, err := buildUpdateStatement(reflect.TypeFor[T]())
+
+	if err != nil {
+		return err
+	}
+
+	transaction, err := begin(db)
+
+	if err != nil {
+		return err
+	}
+
+	stmt, err := transaction.Prepare(statement.query)
+
+	if err != nil {
+		transaction.Rollback()
+		return err
+	}
+
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	written := slices.Clone(entities) // The slice is only changed once committed
+
+	for i := range written {
+		err = callBeforeUpdate(&written[i])
+
+		if err != nil {
+			transaction.Rollback()
+			return err
+		}
+
+		entityValues := reflect.ValueOf(&written[i]).Elem()
+		statement.stamp(entityValues, now)
+
+		res, err := stmt.Exec(statement.parameters(entityValues)...)
+
+		if err != nil {
+			transaction.Rollback()
+			return err
+		}
+
+		if statement.versioned {
+			err = checkVersionedUpdate(res)
+
+			if err != nil {
+				transaction.Rollback()
+				return err
+			}
 		}
 	}
 
-	if entityID == nil {
-		return errors.New("cannot update entity, ID not set")
+	err = transaction.Commit()
+
+	if err != nil {
+		return err
 	}
 
-	parameters = append(parameters, entityID)
+	for i := range written {
+		if statement.versioned {
+			versionValue := reflect.ValueOf(&written[i]).Elem().FieldByIndex(statement.versionField.Index)
+			versionValue.SetInt(versionValue.Int() + 1)
+		}
 
-	query += " WHERE ID = ?;"
+		entities[i] = written[i]
+	}
 
-	return ExecDB(db, query, parameters...)
+	return nil
 }
 
-func UpdateAll[T any](db *sql.DB, entities []T) error {
+func UpdateFields[T any](entity T, columns ...string) (int64, error) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer db.Close()
+
+	return UpdateFieldsDB(db, entity, columns...)
+}
+
+// Only writes the named columns, leaving the rest of the row untouched. Versions are checked as in UpdateDB.
+func UpdateFieldsDB[T any](db DBTX, entity T, columns ...string) (int64, error) {
 	targetType := reflect.TypeFor[T]()
 	tableName := GetTableName(targetType)
-	fields := getExportedFields(targetType)
+	entityValues := reflect.ValueOf(entity)
 
-	query := "UPDATE " + tableName + " SET "
+	if len(columns) == 0 {
+		return 0, errors.New("cannot update entity, no columns given")
+	}
 
-	for i, field := range fields {
-		if field.Name != "ID" {
-			query += field.Name + " = ?"
+	idField, err := getColumnField(targetType, "ID")
 
-			if i != len(fields)-1 {
-				query += ", "
-			}
+	if err != nil {
+		return 0, errors.New("cannot update entity, no ID column")
+	}
+
+	versionField, versioned, err := getVersionField(getExportedFields(targetType))
+
+	if err != nil {
+		return 0, err
+	}
+
+	parameters := []any{}
+	assignments := []string{}
+
+	for _, column := range columns {
+		if column == "ID" {
+			return 0, errors.New("cannot update entity, ID is not updatable")
 		}
+
+		if versioned && column == versionField.Name {
+			return 0, errors.New("cannot update entity, version is managed by dbdt")
+		}
+
+		field, err := getColumnField(targetType, column)
+
+		if err != nil {
+			return 0, err
+		}
+
+		assignments = append(assignments, column+" = ?")
+		parameters = append(parameters, columnValue(entityValues.FieldByIndex(field.Index)))
+	}
+
+	auditFields, err := getAuditFields(getExportedFields(targetType))
+
+	if err != nil {
+		return 0, err
+	}
+
+	if auditFields.hasUpdated && !slices.Contains(columns, auditFields.updated.Name) {
+		assignments = append(assignments, auditFields.updated.Name+" = ?")
+		parameters = append(parameters, time.Now().UTC())
 	}
 
-	query += " WHERE ID = ?;"
+	parameters = append(parameters, entityValues.FieldByIndex(idField.Index).Interface())
+
+	query := "UPDATE \"" + tableName + "\" SET " + strings.Join(assignments, ", ")
+
+	if versioned {
+		query += ", " + versionField.Name + " = " + versionField.Name + " + 1 WHERE ID = ? AND " + versionField.Name + " = ?;"
+		parameters = append(parameters, entityValues.FieldByIndex(versionField.Index).Interface())
+	} else {
+		query += " WHERE ID = ?;"
+	}
 
-	stmt, err := db.Prepare(query)
+	res, err := db.Exec(query, parameters...)
 
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	defer stmt.Close()
+	if versioned {
+		err = checkVersionedUpdate(res)
 
-	transaction, err := db.Begin()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return res.RowsAffected()
+}
+
+func UpdateWhere[T any](set map[string]any, where string, args ...any) (int64, error) {
+	db, err := OpenActiveDB()
 
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	for _, entity := range entities {
-		entityValues := reflect.ValueOf(entity)
-		var entityID any
-		parameters := make([]any, len(fields))
-		paramIndex := 0 // Differs from i, since the ID value goes last
+	defer db.Close()
 
-		for i, field := range fields {
-			if field.Name != "ID" {
-				query += field.Name + " = ?"
+	return UpdateWhereDB[T](db, set, where, args...)
+}
 
-				if i != len(fields)-1 {
-					query += ", "
-				}
+// Sets the given columns on every row matching where, or every row if where is empty.
+// Soft-deleted rows are left alone unless WithDeleted() is passed among args.
+func UpdateWhereDB[T any](db DBTX, set map[string]any, where string, args ...any) (int64, error) {
+	targetType := reflect.TypeFor[T]()
+	tableName := GetTableName(targetType)
+	args, options := splitQueryOptions(args)
 
-				value := entityValues.FieldByIndex(field.Index).Interface()
-				parameters[paramIndex] = value
-				paramIndex++
-			} else {
-				entityID = entityValues.FieldByIndex(field.Index).Interface()
-			}
-		}
+	if len(set) == 0 {
+		return 0, errors.New("cannot update rows, no columns given")
+	}
 
-		if entityID == nil {
-			transaction.Rollback()
-			return errors.New("cannot update entity, ID not set")
-		}
+	columns := slices.Sorted(maps.Keys(set)) // Stable column order for the query
 
-		parameters[paramIndex] = entityID
+	parameters := []any{}
+	assignments := []string{}
 
-		_, err := stmt.Exec(parameters)
+	for _, column := range columns {
+		_, err := getColumnField(targetType, column)
 
 		if err != nil {
-			transaction.Rollback()
-			return err
+			return 0, err
 		}
+
+		assignments = append(assignments, column+" = ?")
+		parameters = append(parameters, set[column])
 	}
 
-	return transaction.Commit()
+	fields := getExportedFields(targetType)
+
+	versionField, versioned, err := getVersionField(fields)
+
+	if err != nil {
+		return 0, err
+	}
+
+	auditFields, err := getAuditFields(fields)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if auditFields.hasUpdated && !slices.Contains(columns, auditFields.updated.Name) {
+		assignments = append(assignments, auditFields.updated.Name+" = ?")
+		parameters = append(parameters, time.Now().UTC())
+	}
+
+	// Bump the version so versioned writers holding these rows see a conflict
+	if versioned && !slices.Contains(columns, versionField.Name) {
+		assignments = append(assignments, versionField.Name+" = "+versionField.Name+" + 1")
+	}
+
+	parameters = append(parameters, args...)
+
+	query := "UPDATE \"" + tableName + "\" SET " + strings.Join(assignments, ", ") + whereClause(targetType, where, options) + ";"
+
+	res, err := db.Exec(query, parameters...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
 }
 
-func Get[T any](id any) (T, error) {
+func Get[T any](id any, options ...QueryOption) (T, error) {
 	db, err := OpenActiveDB()
 
 	if err != nil {
@@ -490,16 +986,18 @@ func Get[T any](id any) (T, error) {
 
 	defer db.Close()
 
-	return GetDB[T](db, id)
+	return GetDB[T](db, id, options...)
 }
 
-func GetDB[T any](db *sql.DB, id any) (T, error) {
+// Soft-deleted rows are not found unless WithDeleted is passed
+func GetDB[T any](db DBTX, id any, options ...QueryOption) (T, error) {
 	targetType := reflect.TypeFor[T]()
 	tableName := GetTableName(targetType)
+	queryOptions := applyQueryOptions(options)
 
-	query := "SELECT * FROM " + tableName + " WHERE ID = ? LIMIT 1"
+	query := "SELECT * FROM " + tableName + " WHERE ID = ?" + notDeletedCondition(targetType, queryOptions, " AND ") + " LIMIT 1"
 
-	entities, err := FindAllDB[T](db, query, id)
+	entities, err := findAllDB[T](db, queryOptions, query, id)
 
 	if err != nil {
 		return *new(T), err
@@ -512,7 +1010,7 @@ func GetDB[T any](db *sql.DB, id any) (T, error) {
 	return entities[0], err
 }
 
-func GetAll[T any]() ([]T, error) {
+func GetAll[T any](options ...QueryOption) ([]T, error) {
 	db, err := OpenActiveDB()
 
 	if err != nil {
@@ -521,16 +1019,18 @@ func GetAll[T any]() ([]T, error) {
 
 	defer db.Close()
 
-	return GetAllDB[T](db)
+	return GetAllDB[T](db, options...)
 }
 
-func GetAllDB[T any](db *sql.DB) ([]T, error) {
+// Soft-deleted rows are excluded unless WithDeleted is passed
+func GetAllDB[T any](db DBTX, options ...QueryOption) ([]T, error) {
 	targetType := reflect.TypeFor[T]()
 	tableName := GetTableName(targetType)
+	queryOptions := applyQueryOptions(options)
 
-	query := "SELECT * FROM " + tableName
+	query := "SELECT * FROM " + tableName + notDeletedCondition(targetType, queryOptions, " WHERE ")
 
-	return FindAllDB[T](db, query)
+	return findAllDB[T](db, queryOptions, query)
 }
 
 func FindAll[T any](query string, args ...any) ([]T, error) {
@@ -545,7 +1045,14 @@ func FindAll[T any](query string, args ...any) ([]T, error) {
 	return FindAllDB[T](db, query, args...)
 }
 
-func FindAllDB[T any](db *sql.DB, query string, args ...any) ([]T, error) {
+// Soft-deleted rows are dropped from the results unless WithDeleted() is passed among args
+func FindAllDB[T any](db DBTX, query string, args ...any) ([]T, error) {
+	args, options := splitQueryOptions(args)
+
+	return findAllDB[T](db, options, query, args...)
+}
+
+func findAllDB[T any](db DBTX, options queryOptions, query string, args ...any) ([]T, error) {
 	grid, err := GetGridDB(db, query, args...)
 
 	if err != nil {
@@ -605,12 +1112,32 @@ func FindAllDB[T any](db *sql.DB, query string, args ...any) ([]T, error) {
 				field.SetFloat(v)
 			case []byte:
 				field.SetBytes(v)
+			case time.Time:
+				if field.Type() == timeType {
+					field.Set(reflect.ValueOf(v))
+				}
 			}
 		}
 
 		output[rowIndex] = entity
 	}
 
+	if !options.withDeleted {
+		output, err = excludeDeleted(output)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range output {
+		err = callAfterLoad(&output[i])
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return output, nil
 }
 
@@ -626,7 +1153,7 @@ func Exec(query string, args ...any) error {
 	return ExecDB(db, query, args...)
 }
 
-func ExecDB(db *sql.DB, query string, args ...any) error {
+func ExecDB(db DBTX, query string, args ...any) error {
 	_, err := db.Exec(query, args...)
 
 	return err
@@ -644,7 +1171,7 @@ func GetSingle[T any](query string, args ...any) (T, error) {
 	return GetSingleDB[T](db, query, args...)
 }
 
-func GetSingleDB[T any](db *sql.DB, query string, args ...any) (T, error) {
+func GetSingleDB[T any](db DBTX, query string, args ...any) (T, error) {
 	row := db.QueryRow(query, args...)
 
 	value := *new(T)
@@ -675,7 +1202,7 @@ func GetGrid(query string, args ...any) (Grid, error) {
 	return GetGridDB(db, query, args...)
 }
 
-func GetGridDB(db *sql.DB, query string, args ...any) (Grid, error) {
+func GetGridDB(db DBTX, query string, args ...any) (Grid, error) {
 	rows, err := db.Query(query, args...)
 
 	if err != nil {
@@ -729,7 +1256,7 @@ func GetRows(query string, args ...any) ([]map[string]any, error) {
 	return GetRowsDB(db, query, args...)
 }
 
-func GetRowsDB(db *sql.DB, query string, args ...any) ([]map[string]any, error) {
+func GetRowsDB(db DBTX, query string, args ...any) ([]map[string]any, error) {
 	rows, err := db.Query(query, args...)
 
 	if err != nil {
@@ -788,7 +1315,7 @@ func GetRow(query string, args ...any) (map[string]any, error) {
 	return GetRowDB(db, query, args...)
 }
 
-func GetRowDB(db *sql.DB, query string, args ...any) (map[string]any, error) {
+func GetRowDB(db DBTX, query string, args ...any) (map[string]any, error) {
 	rows, err := db.Query(query, args...)
 
 	if err != nil {
@@ -842,7 +1369,7 @@ func GetColumn[T any](query string, args ...any) ([]T, error) {
 	return GetColumnDB[T](db, query, args...)
 }
 
-func GetColumnDB[T any](db *sql.DB, query string, args ...any) ([]T, error) {
+func GetColumnDB[T any](db DBTX, query string, args ...any) ([]T, error) {
 	rows, err := db.Query(query, args...)
 
 	if err != nil {
@@ -866,3 +1393,32 @@ func GetColumnDB[T any](db *sql.DB, query string, args ...any) ([]T, error) {
 
 	return values, nil
 }
+
+// Yields the items of successive pages, stopping after a short page. readPage is given the last item of the
+// previous page, or nil for the first. Iteration stops after yielding an error.
+func paged[E any](pageSize int, readPage func(last *E) ([]E, error)) iter.Seq2[E, error] {
+	return func(yield func(E, error) bool) {
+		last := (*E)(nil)
+
+		for {
+			page, err := readPage(last)
+
+			if err != nil {
+				yield(*new(E), err)
+				return
+			}
+
+			for _, item := range page {
+				if !yield(item, nil) {
+					return
+				}
+			}
+
+			if len(page) < pageSize {
+				return
+			}
+
+			last = &page[len(page)-1]
+		}
+	}
+}
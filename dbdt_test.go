@@ -2,10 +2,20 @@ package dbdt
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -281,10 +291,12 @@ func TestDBWatcherCallbackFires(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	callbackActivated := false
+	defer watcher.Close()
+
+	callbackActivated := atomic.Bool{}
 
 	callback := func() {
-		callbackActivated = true
+		callbackActivated.Store(true)
 	}
 
 	watcher.AddCallback(callback)
@@ -297,141 +309,3011 @@ func TestDBWatcherCallbackFires(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 20)
 
-	if !callbackActivated {
+	if !callbackActivated.Load() {
 		t.Fatal("Callback never activated")
 	}
 }
 
-func TestDBWatcherHandlesData(t *testing.T) {
+// Goroutines can take a moment to exit after their channels close
+func waitForGoroutines(t *testing.T, want int) {
+	deadline := time.Now().Add(time.Second)
+
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected at most %d goroutines, got %d", want, runtime.NumGoroutine())
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestDBWatcherLifecycle(t *testing.T) {
+	err := Exec("CREATE TABLE IF NOT EXISTS lifecycle (value ANY)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+
 	watcher, err := CreateDBWatcher(activeDB)
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	Exec("CREATE TABLE source (value ANY)")
-	Exec("CREATE TABLE dest (value ANY)")
+	calls := atomic.Int32{}
+	watcher.AddCallback(func() { calls.Add(1) })
 
-	callback := func() {
-		data, err := GetSingle[string]("SELECT * FROM source")
+	watcher.Start() // Already started, must not add a second poller
+	watcher.Stop()
+
+	err = Exec("INSERT INTO lifecycle VALUES (1)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 30)
+
+	if calls.Load() != 0 {
+		t.Fatal("callback ran while stopped")
+	}
+
+	watcher.Start()
+	time.Sleep(time.Millisecond * 30)
+
+	if calls.Load() != 1 {
+		t.Fatalf("expected the change to be seen once after restarting, got %d", calls.Load())
+	}
+
+	err = watcher.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = watcher.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher.Start() // Closed watchers stay closed
+
+	waitForGoroutines(t, before)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	_, err = CreateDBWatcherContext(ctx, activeDB)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	waitForGoroutines(t, before)
+
+	// The context can be done while the watcher is still being created, either creation fails or the watcher closes
+	for range 20 {
+		ctx, cancel := context.WithCancel(context.Background())
+		go cancel()
+
+		_, err = CreateDBWatcherContext(ctx, activeDB)
+
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Fatal(err)
+		}
+	}
+
+	waitForGoroutines(t, before)
+}
+
+func TestDBWatcherCallbackRegistration(t *testing.T) {
+	err := Exec("CREATE TABLE IF NOT EXISTS registration (value ANY)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := CreateDBWatcher(activeDB)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer watcher.Close()
+
+	log.SetOutput(io.Discard) // The panic below is logged
+	defer log.SetOutput(os.Stderr)
+
+	calls := atomic.Int32{}
+
+	watcher.AddCallback(func() { panic("callback failed") })
+	unsubscribe := watcher.AddCallback(func() { calls.Add(1) })
+
+	// Registering while the watcher polls must be safe, see go test -race
+	for range 10 {
+		watcher.AddCallback(func() {})()
+	}
+
+	write := func() {
+		err := Exec("INSERT INTO registration VALUES (1)")
 
 		if err != nil {
-			return
+			t.Fatal(err)
 		}
 
-		err = Exec("INSERT INTO dest VALUES (?)", data)
+		time.Sleep(time.Millisecond * 30)
+	}
+
+	write()
+
+	if calls.Load() != 1 {
+		t.Fatalf("expected the callback after a panicking one to run once, got %d", calls.Load())
+	}
+
+	unsubscribe()
+	unsubscribe()
+	write()
+
+	if calls.Load() != 1 {
+		t.Fatal("callback ran after unsubscribing")
+	}
+}
+
+func TestDBWatcherOptions(t *testing.T) {
+	_, err := CreateDBWatcher(activeDB, WithPollInterval(0))
+
+	if err == nil {
+		t.Fatal("expected a zero poll interval to be rejected")
+	}
+
+	err = Exec("CREATE TABLE IF NOT EXISTS burst (value ANY)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := CreateDBWatcher(activeDB, WithPollInterval(time.Millisecond*5), WithBackoff(time.Millisecond*40), WithDebounce(time.Millisecond*100))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer watcher.Close()
+
+	calls := atomic.Int32{}
+	watcher.AddCallback(func() { calls.Add(1) })
+
+	time.Sleep(time.Millisecond * 200) // Let the interval back off
+
+	for i := range 5 {
+		err = Exec("INSERT INTO burst VALUES (?)", i)
 
 		if err != nil {
-			panic(err)
+			t.Fatal(err)
 		}
+
+		time.Sleep(time.Millisecond * 10)
 	}
 
-	watcher.AddCallback(callback)
+	time.Sleep(time.Millisecond * 200)
 
-	err = Exec("INSERT INTO source VALUES (?)", "test")
+	if calls.Load() != 1 {
+		t.Fatalf("expected the burst to cause one call, got %d", calls.Load())
+	}
+}
+
+func TestWatchTables(t *testing.T) {
+	err := CreateTable[Order]()
 
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 
-	time.Sleep(time.Millisecond * 20)
+	err = CreateTable[Customer]()
 
-	retValue, err := GetSingle[string]("SELECT * FROM dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := CreateDBWatcher(activeDB)
 
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 
-	if retValue != "test" {
-		t.Fatal("failed to move value from source to dest")
+	defer watcher.Close()
+
+	_, err = watcher.WatchTables(func() {}, "missing")
+
+	if err == nil {
+		t.Fatal("expected watching a missing table to fail")
 	}
-}
 
-func TestDBGetGrid(t *testing.T) {
-	err := Exec("CREATE TABLE IF NOT EXISTS gridtest (id INTEGER PRIMARY KEY, value TEXT)")
+	orderCalls := atomic.Int32{}
+	anyCalls := atomic.Int32{}
+
+	_, err = WatchTable[Order](watcher, func() { orderCalls.Add(1) })
+
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = Exec("DELETE FROM gridtest")
+	_, err = watcher.WatchTables(func() { anyCalls.Add(1) }, "Orders", "Customers")
+
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	values := []string{"A", "B", "C", "D"}
-	for i, v := range values {
-		err = Exec("INSERT INTO gridtest VALUES (?, ?)", i+1, v)
+	wait := func() { time.Sleep(time.Millisecond * 30) }
+
+	err = Insert(&Customer{Name: "watched"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait()
+
+	if orderCalls.Load() != 0 || anyCalls.Load() != 1 {
+		t.Fatalf("expected only the Customer watcher to run, got %d and %d calls", orderCalls.Load(), anyCalls.Load())
+	}
+
+	order := Order{Customer: "watched", Total: 5}
+
+	err = Insert(&order)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait()
+
+	err = Exec("DELETE FROM Orders WHERE ID = ?", order.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait()
+
+	if orderCalls.Load() != 2 || anyCalls.Load() != 3 {
+		t.Fatalf("expected both watchers to run for each Order change, got %d and %d calls", orderCalls.Load(), anyCalls.Load())
+	}
+}
+
+func TestDBWatcherEvents(t *testing.T) {
+	_, err := CreateDBWatcher(activeDB, WithEventBuffer(0))
+
+	if err == nil {
+		t.Fatal("expected an unbuffered DropOldest watcher to be rejected")
+	}
+
+	err = Exec("CREATE TABLE IF NOT EXISTS events (value ANY)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func() {
+		err := Exec("INSERT INTO events VALUES (1)")
+
 		if err != nil {
 			t.Fatal(err)
 		}
+
+		time.Sleep(time.Millisecond * 30)
 	}
 
-	grid, err := GetGrid("SELECT * FROM gridtest")
+	watcher, err := CreateDBWatcher(activeDB, WithEventBuffer(1))
+
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(grid.Rows) != len(values) {
-		t.Fatalf("expected %d rows, got %d", len(values), len(grid.Rows))
+	events := watcher.Events()
+
+	write()
+	first := <-events
+
+	write()
+	write()
+
+	if len(events) != 1 {
+		t.Fatalf("expected the buffer to hold one event, got %d", len(events))
 	}
 
-	for i, expectedValue := range values {
-		gotValue := grid.Rows[i][1] // Second column is Value
+	latest := <-events
 
-		if expectedValue != gotValue {
-			t.Fatalf("expected %v, got %v", expectedValue, gotValue)
+	if latest.DataVersion <= first.DataVersion || latest.Time.Before(first.Time) {
+		t.Fatalf("expected the oldest event to be dropped, got %v after %v", latest, first)
+	}
+
+	errs := watcher.Errors()
+
+	watcher.conn.Close() // Make polling fail
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("expected an error")
 		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the polling error to be reported")
+	}
+
+	watcher.Close()
+
+	_, open := <-events
+
+	if open {
+		t.Fatal("expected Close to close the events channel")
+	}
+
+	blocking, err := CreateDBWatcher(activeDB, WithEventBuffer(0), WithOverflow(Block))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := atomic.Int32{}
+	blocking.AddCallback(func() { calls.Add(1) })
+	blocking.Events()
+
+	write()
+
+	if calls.Load() != 0 {
+		t.Fatal("expected callbacks to wait for the event to be read")
+	}
+
+	err = blocking.Close() // Must not hang on the unread event
+
+	if err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestColumnMismatch(t *testing.T) {
-	type Person struct {
-		ID   int
-		Name string
-		Age  int
+func TestCommitNotifications(t *testing.T) {
+	err := Exec("CREATE TABLE IF NOT EXISTS commits (value ANY)")
+
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	err := Exec("DROP TABLE IF EXISTS Person")
+	commits := make(chan []RowChange, 10)
+	unsubscribe := SubscribeCommits(func(changes []RowChange) { commits <- changes })
+
+	defer unsubscribe()
+
+	db, err := OpenActiveDB()
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = Exec(`CREATE TABLE Persons (
-		ID INTEGER PRIMARY KEY,
-		Name TEXT,
-		ExtraColumn TEXT,
-		AnotherExtra INTEGER
-	);
-	
-	INSERT INTO Persons VALUES (null, 'Alice', 'error', -1);
-	`)
+	defer db.Close()
+
+	tx, err := db.Begin()
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	people, err := GetAll[Person]()
+	_, err = tx.Exec("INSERT INTO commits VALUES ('rolled back')")
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(people) != 1 {
-		t.Fatal("expected 1 person, got", len(people))
+	err = tx.Rollback()
+
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	person := people[0]
+	res, err := db.Exec("INSERT INTO commits VALUES ('committed')")
 
-	if person.ID != 1 {
-		t.Fatal("expected ID=1, got", person.ID)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if person.Name != "Alice" {
-		t.Fatal("expected Name='Alice', got", person.Name)
+	rowID, err := res.LastInsertId()
+
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if person.Age != 0 {
-		t.Fatal("expected Age=0 (zero value for missing column), got", person.Age)
+	select {
+	case changes := <-commits:
+		if len(changes) != 1 || changes[0].Table != "commits" || changes[0].Op != ChangeInsert || changes[0].RowID != rowID ||
+			!strings.HasSuffix(changes[0].Database, "data.db") {
+			t.Fatalf("expected the committed insert only, got %v", changes)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("commit never published")
+	}
+
+	tx, err = db.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = tx.Exec("INSERT INTO commits VALUES ('kept')")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rowID, err = res.LastInsertId()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{"SAVEPOINT inner", "INSERT INTO commits VALUES ('undone')", "ROLLBACK TO inner", "RELEASE inner"} {
+		_, err = tx.Exec(query)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case changes := <-commits:
+		if len(changes) != 1 || changes[0].RowID != rowID {
+			t.Fatalf("expected only the row outside the rolled back savepoint, got %v", changes)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("commit never published")
+	}
+
+	// A failing statement is undone without ending the transaction, so its rows are not published
+	err = Exec("CREATE TABLE IF NOT EXISTS unique_commits (id INTEGER PRIMARY KEY)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Exec("DELETE FROM unique_commits")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err = db.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tx.Exec("INSERT INTO unique_commits VALUES (1)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tx.Exec("INSERT INTO unique_commits VALUES (2), (1)")
+
+	if err == nil {
+		t.Fatal("expected the duplicate id to fail")
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case changes := <-commits:
+		if len(changes) != 1 || changes[0].Table != "unique_commits" || changes[0].RowID != 1 {
+			t.Fatalf("expected only the row from the statement that succeeded, got %v", changes)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("commit never published")
+	}
+
+	// Polling alone would not notice the change within the test
+	watcher, err := CreateDBWatcher(activeDB, WithPollInterval(time.Hour))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer watcher.Close()
+
+	called := make(chan struct{}, 1)
+	watcher.AddCallback(func() { called <- struct{}{} })
+
+	err = Exec("UPDATE commits SET value = 'updated'")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("watcher not woken by an in-process commit")
+	}
+}
+
+func TestDBWatcherFileNotifications(t *testing.T) {
+	err := Exec("CREATE TABLE IF NOT EXISTS notified (value ANY)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+
+	watcher, err := CreateDBWatcher(activeDB, WithFileNotifications(), WithPollInterval(time.Hour))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !watcher.FileNotifications() {
+		watcher.Close()
+		t.Skip("file notifications unavailable")
+	}
+
+	called := make(chan struct{}, 1)
+	watcher.AddCallback(func() { called <- struct{}{} })
+
+	// The plain driver has no commit hooks, so only the file notification can wake the watcher
+	db, err := sql.Open("sqlite3", activeDB)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("INSERT INTO notified VALUES (1)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("watcher not woken by the file notification")
+	}
+
+	err = watcher.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForGoroutines(t, before)
+
+	// If notifications stop, the watcher says so and polls as usual, rather than at the slow safety interval
+	watcher, err = CreateDBWatcher(activeDB, WithFileNotifications(), WithPollInterval(time.Millisecond*5))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer watcher.Close()
+
+	watcher.AddCallback(func() { called <- struct{}{} })
+	errs := watcher.Errors()
+	watcher.notifier.Close()
+
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "file notifications stopped") {
+			t.Fatal("unexpected error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stopped notifications never reported")
+	}
+
+	if watcher.FileNotifications() {
+		t.Fatal("expected the watcher to report that it is polling")
+	}
+
+	db, err = sql.Open("sqlite3", activeDB)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO notified VALUES (2)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-called:
+	case <-time.After(notifySafetyInterval / 2):
+		t.Fatal("watcher did not fall back to polling")
+	}
+}
+
+func TestOpenOptions(t *testing.T) {
+	_, err := OpenDB(activeDB, WithBusyTimeout(-time.Second))
+
+	if err == nil {
+		t.Fatal("expected a negative busy timeout to be rejected")
+	}
+
+	db, err := OpenDB(filepath.Join(activeFolder, "options.db"), WithWAL(), WithBusyTimeout(time.Second*2),
+		WithSynchronous(SynchronousFull), WithForeignKeys(), WithCacheSize(-4096), WithMmap(1<<20))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	expected := map[string]int64{
+		"busy_timeout": 2000,
+		"synchronous":  2, // FULL
+		"foreign_keys": 1,
+		"cache_size":   -4096,
+		"mmap_size":    1 << 20,
+	}
+
+	// Hold two connections at once, so both come from the pool separately
+	ctx := context.Background()
+
+	for range 2 {
+		conn, err := db.Conn(ctx)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+
+		journalMode := ""
+
+		err = conn.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode)
+
+		if err != nil || journalMode != "wal" {
+			t.Fatalf("expected WAL, got %q %v", journalMode, err)
+		}
+
+		for pragma, want := range expected {
+			got := int64(0)
+
+			err = conn.QueryRowContext(ctx, "PRAGMA "+pragma).Scan(&got)
+
+			if err != nil || got != want {
+				t.Fatalf("expected %s %d, got %d %v", pragma, want, got, err)
+			}
+		}
+	}
+
+	SetDefaultOpenOptions(WithForeignKeys())
+	defer SetDefaultOpenOptions()
+
+	foreignKeys, err := GetSingle[int]("PRAGMA foreign_keys")
+
+	if err != nil || foreignKeys != 1 {
+		t.Fatalf("expected default options to apply to the active DB, got %d %v", foreignKeys, err)
+	}
+}
+
+type Chore struct {
+	ID     int
+	Title  string
+	Done   bool
+	Points float64
+	Due    time.Time `db:""`
+}
+
+func TestChangeFeed(t *testing.T) {
+	err := CreateTable[Chore]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = EnableChangeFeed[Chore]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = PruneChanges(math.MaxInt64) // Start from an empty feed when tests are repeated
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	due := time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)
+	chore := Chore{0, "write tests", false, 1.5, due}
+
+	err = Insert(&chore)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := chore
+	done.Done = true
+
+	err = Update(done)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Exec("DELETE FROM Chores WHERE ID = ?", chore.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := []Change[Chore]{}
+
+	for change, err := range Changes[Chore](0) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		changes = append(changes, change)
+	}
+
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %v", changes)
+	}
+
+	expected := []struct {
+		op       ChangeOp
+		old, new Chore
+	}{
+		{ChangeInsert, Chore{}, chore},
+		{ChangeUpdate, chore, done},
+		{ChangeDelete, done, Chore{}},
+	}
+
+	for i, change := range changes {
+		want := expected[i]
+
+		if change.Op != want.op || change.Old.Title != want.old.Title || change.New.Title != want.new.Title ||
+			change.Old.Done != want.old.Done || change.New.Done != want.new.Done ||
+			!change.Old.Due.Equal(want.old.Due) || !change.New.Due.Equal(want.new.Due) || change.New.Points != want.new.Points {
+			t.Fatalf("change %d: expected %v, got %v", i, want, change)
+		}
+	}
+
+	checkpoint, err := LoadChangeCheckpoint("new-consumer")
+
+	if err != nil || checkpoint != 0 {
+		t.Fatalf("expected no checkpoint for a new consumer, got %d %v", checkpoint, err)
+	}
+
+	err = SaveChangeCheckpoint("test-consumer", changes[1].Seq)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err = LoadChangeCheckpoint("test-consumer")
+
+	if err != nil || checkpoint != changes[1].Seq {
+		t.Fatalf("expected checkpoint %d, got %d %v", changes[1].Seq, checkpoint, err)
+	}
+
+	watcher, err := CreateDBWatcher(activeDB)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer watcher.Close()
+
+	received := make(chan Change[Chore], 10)
+
+	_, err = SubscribeChanges(watcher, checkpoint, func(change Change[Chore]) { received <- change })
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(received) != 1 || (<-received).Op != ChangeDelete {
+		t.Fatal("expected the change after the checkpoint to be delivered on subscribing")
+	}
+
+	err = Insert(&Chore{Title: "live"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case change := <-received:
+		if change.Op != ChangeInsert || change.New.Title != "live" {
+			t.Fatalf("expected the live insert, got %v", change)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("live change never delivered")
+	}
+
+	pruned, err := PruneChanges(checkpoint)
+
+	if err != nil || pruned != 2 {
+		t.Fatalf("expected 2 changes pruned, got %d %v", pruned, err)
+	}
+}
+
+func TestSubscribeChangesErrors(t *testing.T) {
+	err := CreateTable[Receipt]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = EnableChangeFeed[Receipt]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer DisableChangeFeed[Receipt]()
+
+	err = Exec(`INSERT INTO __dbdt_changes (table_name, row_id, op, new_json, changed_at)
+		VALUES ('Receipts', 1, 'insert', 'not json', 0)`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer Exec("DELETE FROM __dbdt_changes WHERE table_name = 'Receipts'")
+
+	watcher, err := CreateDBWatcher(activeDB)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer watcher.Close()
+
+	errs := watcher.Errors()
+
+	_, err = SubscribeChanges(watcher, 0, func(change Change[Receipt]) {
+		t.Fatal("expected the malformed change not to be delivered")
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-errs:
+		if !strings.Contains(err.Error(), "Receipts") {
+			t.Fatal("expected the error to name the table, got", err)
+		}
+	default:
+		t.Fatal("expected the read error on the watcher's Errors channel")
+	}
+}
+
+func TestChangeFeedBlobs(t *testing.T) {
+	err := CreateTable[Entity]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = EnableChangeFeed[Entity]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer DisableChangeFeed[Entity]()
+
+	since, err := GetSingle[int64]("SELECT COALESCE(MAX(seq), 0) FROM __dbdt_changes")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entity := Entity{Text: "blob", Data: []byte{0, 1, 2, 255}}
+
+	err = Insert(&entity)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Delete[Entity](entity.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := []Change[Entity]{}
+
+	for change, err := range Changes[Entity](since) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		changes = append(changes, change)
+	}
+
+	if len(changes) != 2 || !bytes.Equal(changes[0].New.Data, entity.Data) || !bytes.Equal(changes[1].Old.Data, entity.Data) {
+		t.Fatalf("expected the blob to round trip through the feed, got %v", changes)
+	}
+}
+
+func TestLiveQuery(t *testing.T) {
+	err := CreateTable[Chore]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Exec("DELETE FROM Chores WHERE Title LIKE 'lq-%' OR Title = 'unrelated'")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := Chore{Title: "lq-first"}
+	unrelated := Chore{Title: "unrelated"}
+
+	err = InsertAll([]*Chore{&first, &unrelated})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := CreateDBWatcher(activeDB)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer watcher.Close()
+
+	type diff struct{ added, removed, changed []Chore }
+	diffs := make(chan diff, 10)
+
+	stop, err := LiveQuery(watcher, "SELECT * FROM Chores WHERE Title LIKE ?", func(added []Chore, removed []Chore, changed []Chore) {
+		diffs <- diff{added, removed, changed}
+	}, "lq-%")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stop()
+
+	titles := func(chores []Chore) string {
+		names := []string{}
+
+		for _, chore := range chores {
+			names = append(names, chore.Title)
+		}
+
+		return strings.Join(names, ",")
+	}
+
+	expect := func(added string, removed string, changed string) {
+		select {
+		case got := <-diffs:
+			if titles(got.added) != added || titles(got.removed) != removed || titles(got.changed) != changed {
+				t.Fatalf("expected +%q -%q ~%q, got +%q -%q ~%q", added, removed, changed,
+					titles(got.added), titles(got.removed), titles(got.changed))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected +%q -%q ~%q, got nothing", added, removed, changed)
+		}
+	}
+
+	expect("lq-first", "", "")
+
+	second := Chore{Title: "lq-second"}
+
+	err = Insert(&second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect("lq-second", "", "")
+
+	first.Points = 3
+
+	err = Update(first)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect("", "", "lq-first")
+
+	unrelated.Points = 3
+
+	err = Update(unrelated)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Exec("DELETE FROM Chores WHERE ID = ?", second.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect("", "lq-second", "") // The unrelated update caused no call
+
+	_, err = LiveQuery(watcher, "SELECT 1 AS ID", func(added []Chore, removed []Chore, changed []Chore) {})
+
+	if err == nil {
+		t.Fatal("expected a query reading no tables to be rejected")
+	}
+}
+
+func TestReadOnlyAndMemory(t *testing.T) {
+	dbPath := filepath.Join(activeFolder, "read-only.db")
+	os.Remove(dbPath)
+
+	db, err := OpenDB(dbPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = CreateTableDB[Chore](db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = InsertDB(db, &Chore{Title: "dishes"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err := AttachKV(db, "key_values")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.Set("colour", "blue")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	readOnly, err := OpenReadOnly(dbPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer readOnly.Close()
+
+	chores, err := FindAllDB[Chore](readOnly, "SELECT * FROM Chores")
+
+	if err != nil || len(chores) != 1 || chores[0].Title != "dishes" {
+		t.Fatalf("expected the chore to be readable, got %v %v", chores, err)
+	}
+
+	err = InsertDB(readOnly, &Chore{Title: "laundry"})
+
+	if !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+
+	kv, err = AttachKV(readOnly, "key_values")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	colour, _, err := kv.Get("colour")
+
+	if err != nil || colour != "blue" {
+		t.Fatalf("expected blue, got %q %v", colour, err)
+	}
+
+	err = kv.Set("colour", "red")
+
+	if !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from the KV store, got %v", err)
+	}
+
+	memory, err := OpenMemory("dbdt-test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = CreateTableDB[Chore](memory)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := CreateDBWatcher(MemoryPath("dbdt-test"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer watcher.Close()
+
+	changed := atomic.Bool{}
+
+	watcher.AddCallback(func() {
+		changed.Store(true)
+	})
+
+	// A separate handle sees the same database
+	other, err := OpenDB(MemoryPath("dbdt-test"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = InsertDB(other, &Chore{Title: "hoovering"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chores, err = FindAllDB[Chore](memory, "SELECT * FROM Chores")
+
+	if err != nil || len(chores) != 1 || chores[0].Title != "hoovering" {
+		t.Fatalf("expected the chore inserted through the other handle, got %v %v", chores, err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	if !changed.Load() {
+		t.Fatal("expected the watcher to see the in-memory write")
+	}
+
+	watcher.Close()
+	other.Close()
+	memory.Close()
+
+	// Closing the last handle discards the database
+	memory, err = OpenMemory("dbdt-test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	exists, err := GetSingleDB[int](memory, "SELECT COUNT(*) FROM sqlite_schema WHERE name = 'Chores'")
+
+	if err != nil || exists != 0 {
+		t.Fatalf("expected a fresh database, got %d %v", exists, err)
+	}
+}
+
+func TestDBWatcherHandlesData(t *testing.T) {
+	watcher, err := CreateDBWatcher(activeDB)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer watcher.Close()
+
+	Exec("CREATE TABLE source (value ANY)")
+	Exec("CREATE TABLE dest (value ANY)")
+
+	callback := func() {
+		data, err := GetSingle[string]("SELECT * FROM source")
+
+		if err != nil {
+			return
+		}
+
+		err = Exec("INSERT INTO dest VALUES (?)", data)
+
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	watcher.AddCallback(callback)
+
+	err = Exec("INSERT INTO source VALUES (?)", "test")
+
+	if err != nil {
+		panic(err)
+	}
+
+	time.Sleep(time.Millisecond * 20)
+
+	retValue, err := GetSingle[string]("SELECT * FROM dest")
+
+	if err != nil {
+		panic(err)
+	}
+
+	if retValue != "test" {
+		t.Fatal("failed to move value from source to dest")
+	}
+}
+
+func TestDBGetGrid(t *testing.T) {
+	err := Exec("CREATE TABLE IF NOT EXISTS gridtest (id INTEGER PRIMARY KEY, value TEXT)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Exec("DELETE FROM gridtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := []string{"A", "B", "C", "D"}
+	for i, v := range values {
+		err = Exec("INSERT INTO gridtest VALUES (?, ?)", i+1, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grid, err := GetGrid("SELECT * FROM gridtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(grid.Rows) != len(values) {
+		t.Fatalf("expected %d rows, got %d", len(values), len(grid.Rows))
+	}
+
+	for i, expectedValue := range values {
+		gotValue := grid.Rows[i][1] // Second column is Value
+
+		if expectedValue != gotValue {
+			t.Fatalf("expected %v, got %v", expectedValue, gotValue)
+		}
+	}
+}
+
+func TestColumnMismatch(t *testing.T) {
+	type Person struct {
+		ID   int
+		Name string
+		Age  int
+	}
+
+	err := Exec("DROP TABLE IF EXISTS Person")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Exec(`CREATE TABLE Persons (
+		ID INTEGER PRIMARY KEY,
+		Name TEXT,
+		ExtraColumn TEXT,
+		AnotherExtra INTEGER
+	);
+	
+	INSERT INTO Persons VALUES (null, 'Alice', 'error', -1);
+	`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	people, err := GetAll[Person]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(people) != 1 {
+		t.Fatal("expected 1 person, got", len(people))
+	}
+
+	person := people[0]
+
+	if person.ID != 1 {
+		t.Fatal("expected ID=1, got", person.ID)
+	}
+
+	if person.Name != "Alice" {
+		t.Fatal("expected Name='Alice', got", person.Name)
+	}
+
+	if person.Age != 0 {
+		t.Fatal("expected Age=0 (zero value for missing column), got", person.Age)
+	}
+}
+
+type Order struct {
+	ID       int
+	Customer string
+	Total    float64
+	Quantity int
+}
+
+func TestAggregates(t *testing.T) {
+	err := Exec("DROP TABLE IF EXISTS Orders")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = CreateTable[Order]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AddAll([]Order{
+		{0, "Alice", 10.5, 1},
+		{0, "Alice", 20, 2},
+		{0, "Bob", 5, 3},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := Count[Order]("Customer = ?", "Alice")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Fatal("expected 2 orders for Alice, got", count)
+	}
+
+	exists, err := Exists[Order](1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists {
+		t.Fatal("expected order 1 to exist")
+	}
+
+	exists, err = Exists[Order](100)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists {
+		t.Fatal("expected order 100 not to exist")
+	}
+
+	total, err := Sum[Order, float64]("Total", "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total != 35.5 {
+		t.Fatal("expected total of 35.5, got", total)
+	}
+
+	maxQuantity, err := Max[Order, int]("Quantity", "Customer = ?", "Alice")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if maxQuantity != 2 {
+		t.Fatal("expected max quantity of 2, got", maxQuantity)
+	}
+
+	minQuantity, err := Min[Order, int]("Quantity", "Customer = ?", "Nobody")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if minQuantity != 0 {
+		t.Fatal("expected zero value for an empty aggregate, got", minQuantity)
+	}
+
+	average, err := Avg[Order, float64]("Quantity", "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if average != 2 {
+		t.Fatal("expected average quantity of 2, got", average)
+	}
+
+	_, err = Sum[Order, int]("Missing", "")
+
+	if err == nil {
+		t.Fatal("expected an error for an unknown column")
+	}
+
+	counts, err := GroupCount[Order]("Customer")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counts["Alice"] != 2 || counts["Bob"] != 1 {
+		t.Fatal("unexpected group counts", counts)
+	}
+}
+
+type Customer struct {
+	ID    int
+	Name  string
+	Email string
+}
+
+func TestUpdateFields(t *testing.T) {
+	err := Exec("DROP TABLE IF EXISTS Customers")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = CreateTable[Customer]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	customer := Customer{0, "Alice", "alice@email.com"}
+
+	err = Insert(&customer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer changes the name, this copy only changes the email
+	_, err = UpdateWhere[Customer](map[string]any{"Name": "Alicia"}, "ID = ?", customer.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	customer.Email = "alicia@email.com"
+
+	affected, err := UpdateFields(customer, "Email")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if affected != 1 {
+		t.Fatal("expected 1 row affected, got", affected)
+	}
+
+	returned, err := Get[Customer](customer.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if returned.Name != "Alicia" || returned.Email != "alicia@email.com" {
+		t.Fatal("partial update overwrote or lost a change", returned)
+	}
+
+	_, err = UpdateFields(customer, "Missing")
+
+	if err == nil {
+		t.Fatal("expected an error for an unknown column")
+	}
+
+	_, err = UpdateWhere[Customer](map[string]any{"Missing": 1}, "")
+
+	if err == nil {
+		t.Fatal("expected an error for an unknown column")
+	}
+}
+
+type Account struct {
+	ID      int
+	Balance int
+	Version int `db:",version"`
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	err := CreateTable[Account]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account := Account{0, 100, 1}
+
+	err = Insert(&account)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := account
+	second := account
+
+	first.Balance = 150
+
+	err = Update(first)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second.Balance = 50
+
+	err = Update(second)
+
+	if !errors.Is(err, ErrStaleVersion) {
+		t.Fatal("expected ErrStaleVersion, got", err)
+	}
+
+	returned, err := Get[Account](account.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if returned.Balance != 150 || returned.Version != 2 {
+		t.Fatal("expected first write to persist with version 2, got", returned)
+	}
+
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	accounts := []Account{returned}
+	accounts[0].Balance = 200
+
+	err = UpdateAll(db, accounts)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if accounts[0].Version != 3 {
+		t.Fatal("expected UpdateAll to increment the version in the slice, got", accounts[0].Version)
+	}
+
+	err = UpdateAll(db, []Account{returned})
+
+	if !errors.Is(err, ErrStaleVersion) {
+		t.Fatal("expected ErrStaleVersion from UpdateAll, got", err)
+	}
+}
+
+type Note struct {
+	ID        int
+	Text      string
+	CreatedAt time.Time `db:",created"`
+	UpdatedAt time.Time `db:",updated"`
+	DeletedAt time.Time `db:",deleted"`
+}
+
+func TestTimestampsAndSoftDelete(t *testing.T) {
+	err := CreateTable[Note]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	note := Note{Text: "first"}
+
+	err = Insert(&note)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if note.CreatedAt.IsZero() || note.UpdatedAt.IsZero() {
+		t.Fatal("expected insert to set timestamps", note)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	note.Text = "second"
+	note.CreatedAt = time.Time{} // Should not be written by an update
+
+	err = Update(note)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	returned, err := Get[Note](note.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if returned.CreatedAt.IsZero() || !returned.UpdatedAt.After(returned.CreatedAt) {
+		t.Fatal("expected update to keep CreatedAt and advance UpdatedAt", returned)
+	}
+
+	if !returned.DeletedAt.IsZero() {
+		t.Fatal("expected DeletedAt to be unset", returned.DeletedAt)
+	}
+
+	err = Delete[Note](note.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Get[Note](note.ID)
+
+	if err == nil {
+		t.Fatal("expected soft-deleted note not to be found")
+	}
+
+	deleted, err := Get[Note](note.ID, WithDeleted())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted.DeletedAt.IsZero() {
+		t.Fatal("expected DeletedAt to be set")
+	}
+
+	notes, err := GetAll[Note]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(notes) != 0 {
+		t.Fatal("expected GetAll to exclude soft-deleted notes, got", len(notes))
+	}
+
+	notes, err = FindAll[Note]("SELECT * FROM Notes")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(notes) != 0 {
+		t.Fatal("expected FindAll to exclude soft-deleted notes, got", len(notes))
+	}
+
+	notes, err = FindAll[Note]("SELECT * FROM Notes WHERE ID = ?", note.ID, WithDeleted())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(notes) != 1 {
+		t.Fatal("expected FindAll with WithDeleted to include the note, got", len(notes))
+	}
+
+	exists, err := Exists[Note](note.ID)
+
+	if err != nil || exists {
+		t.Fatal("expected Exists to skip the soft-deleted note", exists, err)
+	}
+
+	exists, err = Exists[Note](note.ID, WithDeleted())
+
+	if err != nil || !exists {
+		t.Fatal("expected Exists with WithDeleted to find the note", exists, err)
+	}
+
+	count, err := Count[Note]("ID = ?", note.ID)
+
+	if err != nil || count != 0 {
+		t.Fatal("expected Count to skip the soft-deleted note, got", count, err)
+	}
+
+	count, err = Count[Note]("ID = ?", note.ID, WithDeleted())
+
+	if err != nil || count != 1 {
+		t.Fatal("expected Count with WithDeleted to include the note, got", count, err)
+	}
+
+	maxID, err := Max[Note, int]("ID", "ID = ?", note.ID)
+
+	if err != nil || maxID != 0 {
+		t.Fatal("expected Max to skip the soft-deleted note, got", maxID, err)
+	}
+
+	groups, err := GroupCount[Note]("Text")
+
+	if err != nil || groups["second"] != 0 {
+		t.Fatal("expected GroupCount to skip the soft-deleted note, got", groups, err)
+	}
+
+	updated, err := UpdateWhere[Note](map[string]any{"Text": "third"}, "ID = ?", note.ID)
+
+	if err != nil || updated != 0 {
+		t.Fatal("expected UpdateWhere to leave the soft-deleted note alone, got", updated, err)
+	}
+}
+
+type Reminder struct {
+	ID   int
+	Text string
+	At   time.Time // Untagged, so not a column
+}
+
+func TestUntaggedTimeIsNotAColumn(t *testing.T) {
+	err := CreateTable[Reminder]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns, err := GetColumn[string]("SELECT name FROM pragma_table_info('Reminders')")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(columns, []string{"ID", "Text"}) {
+		t.Fatal("expected only ID and Text columns, got", columns)
+	}
+
+	err = Add(Reminder{Text: "call", At: time.Now()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type Contact struct {
+	ID     int
+	Email  string
+	domain string
+}
+
+func (contact *Contact) BeforeInsert() error {
+	if contact.Email == "" {
+		return errors.New("email required")
+	}
+
+	contact.Email = strings.ToLower(contact.Email)
+
+	return nil
+}
+
+func (contact *Contact) BeforeUpdate() error {
+	return contact.BeforeInsert()
+}
+
+func (contact *Contact) AfterLoad() error {
+	_, contact.domain, _ = strings.Cut(contact.Email, "@")
+
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	err := CreateTable[Contact]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contact := Contact{Email: "Alice@Email.com"}
+
+	err = Insert(&contact)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	returned, err := Get[Contact](contact.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if returned.Email != "alice@email.com" {
+		t.Fatal("expected BeforeInsert to normalise the email, got", returned.Email)
+	}
+
+	if returned.domain != "email.com" {
+		t.Fatal("expected AfterLoad to set the domain, got", returned.domain)
+	}
+
+	err = AddAll([]Contact{{Email: "bob@email.com"}, {Email: ""}})
+
+	if err == nil {
+		t.Fatal("expected BeforeInsert error to abort AddAll")
+	}
+
+	count, err := Count[Contact]("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Fatal("expected AddAll to roll back, got", count, "contacts")
+	}
+
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	returned.Email = ""
+
+	err = UpdateAll(db, []Contact{returned})
+
+	if err == nil {
+		t.Fatal("expected BeforeUpdate error to abort UpdateAll")
+	}
+}
+
+// Records the queries run through it, without exposing Begin
+type recordingDB struct {
+	DBTX
+	queries []string
+}
+
+func (db *recordingDB) Exec(query string, args ...any) (sql.Result, error) {
+	db.queries = append(db.queries, query)
+	return db.DBTX.Exec(query, args...)
+}
+
+type Receipt struct {
+	ID    int
+	Total float64
+}
+
+func (receipt *Receipt) AfterInsert() error {
+	if receipt.Total < 0 {
+		return errors.New("negative total")
+	}
+
+	return nil
+}
+
+func TestAfterInsertRollsBack(t *testing.T) {
+	err := CreateTable[Receipt]()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := Count[Receipt]("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refund := Receipt{Total: -1}
+
+	err = Insert(&refund)
+
+	if err == nil || refund.ID != 0 {
+		t.Fatal("expected Insert to fail and leave the ID unset, got", refund.ID, err)
+	}
+
+	err = AddAll([]Receipt{{Total: 5}, {Total: -5}})
+
+	if err == nil {
+		t.Fatal("expected AddAll to fail")
+	}
+
+	receipts := []*Receipt{{Total: 10}, {Total: -10}}
+
+	err = InsertAll(receipts)
+
+	if err == nil || receipts[0].ID != 0 {
+		t.Fatal("expected InsertAll to fail and clear the ID it gave out, got", receipts[0].ID, err)
+	}
+
+	after, err := Count[Receipt]("")
+
+	if err != nil || after != before {
+		t.Fatalf("expected no rows left behind, had %d, now %d %v", before, after, err)
+	}
+
+	// A retry inserts fresh rows
+	receipts[1].Total = 10
+
+	err = InsertAll(receipts)
+
+	if err != nil || receipts[0].ID == 0 || receipts[0].ID == receipts[1].ID {
+		t.Fatal("expected the retry to insert both receipts", receipts[0].ID, receipts[1].ID, err)
+	}
+}
+
+func TestInsertWithoutAfterInsert(t *testing.T) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	err = CreateTableDB[Contact](db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recording := &recordingDB{DBTX: db}
+
+	err = InsertDB(recording, &Contact{Email: "plain@example.com"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Contact has no AfterInsert, so there is nothing to roll back and no transaction
+	if len(recording.queries) != 1 || !strings.HasPrefix(recording.queries[0], "INSERT") {
+		t.Fatal("expected a single INSERT, got", recording.queries)
+	}
+}
+
+// Wraps a pool, keeping its Begin
+type instrumentedDB struct {
+	*sql.DB
+}
+
+func TestBeginOnWrappedDB(t *testing.T) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	err = CreateTableDB[Contact](db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without Begin, a savepoint could open a transaction on one pooled connection and run inserts on another
+	recording := &recordingDB{DBTX: db}
+
+	err = InsertAllDB(recording, []*Contact{{Email: "a@example.com"}})
+
+	if err == nil || len(recording.queries) != 0 {
+		t.Fatal("expected InsertAllDB to refuse a DBTX without Begin, got", recording.queries, err)
+	}
+
+	err = InsertAllDB(instrumentedDB{db}, []*Contact{{Email: "b@example.com"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tx.Rollback()
+
+	err = InsertAllDB(tx, []*Contact{{Email: "c@example.com"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTypedKeyValue(t *testing.T) {
+	type Settings struct {
+		Theme string
+		Sizes []int
+	}
+
+	_, ok, err := GetValueOf[int]("typed-missing")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok {
+		t.Fatal("expected a missing key to report ok = false")
+	}
+
+	err = SetValueOf("typed-int", 42)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	number, ok, err := GetValueOf[int]("typed-int")
+
+	if err != nil || !ok || number != 42 {
+		t.Fatal("expected 42, got", number, ok, err)
+	}
+
+	err = SetValueOf("typed-empty", "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	empty, ok, err := GetValueOf[string]("typed-empty")
+
+	if err != nil || !ok || empty != "" {
+		t.Fatal("expected a stored empty string to report ok = true, got", empty, ok, err)
+	}
+
+	err = SetValueOf("typed-bool", true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flag, ok, err := GetValueOf[bool]("typed-bool")
+
+	if err != nil || !ok || !flag {
+		t.Fatal("expected true, got", flag, ok, err)
+	}
+
+	settings := Settings{"dark", []int{1, 2, 3}}
+
+	err = SetValueOf("typed-struct", settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	returned, ok, err := GetValueOf[Settings]("typed-struct")
+
+	if err != nil || !ok || returned.Theme != "dark" || len(returned.Sizes) != 3 {
+		t.Fatal("expected settings to round trip, got", returned, ok, err)
+	}
+
+	err = SetValueOf("typed-bytes", []byte{0, 1, 2})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, ok, err := GetValueOf[[]byte]("typed-bytes")
+
+	if err != nil || !ok || !bytes.Equal(data, []byte{0, 1, 2}) {
+		t.Fatal("expected bytes to round trip, got", data, ok, err)
+	}
+
+	storedType, err := GetSingleDB[string](mustOpenKV(t), "SELECT typeof(row_value) FROM key_values WHERE row_key = ?", "typed-bytes")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if storedType != "blob" {
+		t.Fatal("expected bytes to be stored as a blob, got", storedType)
+	}
+}
+
+func mustOpenKV(t *testing.T) *sql.DB {
+	db, err := openKV()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestKVStoreErrors(t *testing.T) {
+	kv := DefaultKV
+
+	_, ok, err := kv.Get("store-missing")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok {
+		t.Fatal("expected a missing key to report ok = false")
+	}
+
+	err = kv.Set("store-key", "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	has, err := kv.Has("store-key")
+
+	if err != nil || !has {
+		t.Fatal("expected key to exist", has, err)
+	}
+
+	err = kv.Delete("store-key")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	has, err = kv.Has("store-key")
+
+	if err != nil || has {
+		t.Fatal("expected key to be deleted", has, err)
+	}
+
+	logged := bytes.Buffer{}
+	SetKVLogger(log.New(&logged, "", 0))
+	defer SetKVLogger(log.Default())
+
+	folder := activeFolder
+	activeFolder = ""
+	defer func() { activeFolder = folder }()
+
+	_, _, err = kv.Get("store-key")
+
+	if err == nil {
+		t.Fatal("expected an error without an active folder")
+	}
+
+	SetValue("store-key", "value")
+
+	if logged.Len() == 0 {
+		t.Fatal("expected SetValue to log through the injected logger")
+	}
+}
+
+func TestKVExpiry(t *testing.T) {
+	kv := DefaultKV
+
+	SetValueTTL("ttl-key", "value", time.Millisecond*50)
+
+	if GetValue("ttl-key") != "value" {
+		t.Fatal("expected key to exist before expiry")
+	}
+
+	remaining, ok, err := kv.TTL("ttl-key")
+
+	if err != nil || !ok || remaining <= 0 || remaining > time.Millisecond*50 {
+		t.Fatal("unexpected TTL", remaining, ok, err)
+	}
+
+	SetValue("ttl-forever", "value")
+
+	remaining, ok, err = kv.TTL("ttl-forever")
+
+	if err != nil || !ok || remaining != 0 {
+		t.Fatal("expected no expiry", remaining, ok, err)
+	}
+
+	stop := kv.StartSweeper(time.Millisecond * 10)
+	defer stop()
+
+	time.Sleep(time.Millisecond * 100)
+
+	if GetValue("ttl-key") != "" {
+		t.Fatal("expected key to expire")
+	}
+
+	count, err := GetSingleDB[int](mustOpenKV(t), "SELECT COUNT(*) FROM key_values WHERE row_key = ?", "ttl-key")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Fatal("expected sweeper to delete the expired key")
+	}
+}
+
+func TestKVMigration(t *testing.T) {
+	db, err := OpenDB(filepath.Join(activeFolder, "old_kv.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	err = ExecDB(db, "CREATE TABLE key_values (row_key TEXT PRIMARY KEY, row_value ANY)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ExecDB(db, "INSERT INTO key_values VALUES ('key', 'value')")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = MigrateKVDB(db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns, err := GetColumnDB[string](db, "SELECT name FROM pragma_table_info('key_values')")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Contains(columns, "expires_at") || !slices.Contains(columns, "namespace") {
+		t.Fatal("expected migration to add expires_at and namespace, got", columns)
+	}
+
+	value, err := GetSingleDB[string](db, "SELECT row_value FROM key_values WHERE namespace = '' AND row_key = 'key'")
+
+	if err != nil || value != "value" {
+		t.Fatal("expected existing keys to survive migration, got", value, err)
+	}
+
+	// Tables from before row_value lost its type already have namespaces, which the rebuild keeps
+	err = ExecDB(db, `CREATE TABLE typed_kv (namespace TEXT NOT NULL DEFAULT '', row_key TEXT NOT NULL, row_value ANY,
+		expires_at INTEGER, PRIMARY KEY (namespace, row_key))`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ExecDB(db, "INSERT INTO typed_kv VALUES ('zips', 'home', 'SW1', NULL)")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ExecDB(db, `CREATE TABLE typed_kv_changes (seq INTEGER PRIMARY KEY AUTOINCREMENT, namespace TEXT NOT NULL,
+		row_key TEXT NOT NULL, old_value ANY, new_value ANY)`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ExecDB(db, "INSERT INTO typed_kv_changes (namespace, row_key, new_value) VALUES ('zips', 'home', 'SW1')")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	typed, err := AttachKV(db, "typed_kv")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valueType, err := GetSingleDB[string](db, "SELECT type FROM pragma_table_info('typed_kv') WHERE name = 'row_value'")
+
+	if err != nil || valueType != "" {
+		t.Fatalf("expected row_value to lose its type, got %q %v", valueType, err)
+	}
+
+	value, _, err = typed.WithNamespace("zips").Get("home")
+
+	if err != nil || value != "SW1" {
+		t.Fatal("expected namespaced keys to survive the rebuild, got", value, err)
+	}
+
+	err = typed.Set("zip", "007")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, _, err = typed.Get("zip")
+
+	if err != nil || value != "007" {
+		t.Fatal("expected the migrated table to keep strings, got", value, err)
+	}
+
+	changes, err := GetColumnDB[string](db, "SELECT typeof(new_value) FROM typed_kv_changes ORDER BY seq")
+
+	if err != nil || !slices.Equal(changes, []string{"text", "text"}) {
+		t.Fatal("expected the change log to be rebuilt with its triggers and keep strings, got", changes, err)
+	}
+}
+
+func TestKVNumericStrings(t *testing.T) {
+	for _, value := range []string{"007", "1.0", "1e3"} {
+		err := SetValueOf("numeric", value)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, _, err := GetValueOf[string]("numeric")
+
+		if err != nil || stored != value {
+			t.Fatalf("expected %q back from GetValueOf, got %q %v", value, stored, err)
+		}
+
+		err = DefaultKV.Set("numeric", value)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, _, err = DefaultKV.Get("numeric")
+
+		if err != nil || stored != value {
+			t.Fatalf("expected %q back from Get, got %q %v", value, stored, err)
+		}
+	}
+
+	err := DefaultKV.Set("code", "007")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swapped, err := DefaultKV.CompareAndSwap("code", "007", "008")
+
+	if err != nil || !swapped {
+		t.Fatal("expected the swap to happen", swapped, err)
+	}
+
+	code, _, err := DefaultKV.Get("code")
+
+	if err != nil || code != "008" {
+		t.Fatal("expected 008 after the swap, got", code, err)
+	}
+
+	// Integers set as strings can still be incremented, and counters still compare as strings
+	err = DefaultKV.Set("count", "5")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := DefaultKV.Increment("count", 1)
+
+	if err != nil || count != 6 {
+		t.Fatal("expected 6, got", count, err)
+	}
+
+	swapped, err = DefaultKV.CompareAndSwap("count", "6", "7")
+
+	if err != nil || !swapped {
+		t.Fatal("expected the counter to compare as a string", swapped, err)
+	}
+
+	_, err = DefaultKV.Increment("code", 1)
+
+	if err == nil {
+		t.Fatal("expected 008 not to be treated as an integer")
+	}
+}
+
+func TestKVNamespaces(t *testing.T) {
+	sessions := KV("sessions")
+
+	_, err := sessions.DeletePrefix("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"user:2", "user:1", "admin:1", "user:10"} {
+		err = sessions.Set(key, "value "+key)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	SetValue("user:1", "default namespace")
+
+	value, _, err := sessions.Get("user:1")
+
+	if err != nil || value != "value user:1" {
+		t.Fatal("expected namespaces not to collide, got", value, err)
+	}
+
+	keys, err := sessions.Keys("user:")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(keys, []string{"user:1", "user:10", "user:2"}) {
+		t.Fatal("expected user keys in lexical order, got", keys)
+	}
+
+	scanned := []string{}
+
+	for entry, err := range sessions.Scan("") {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scanned = append(scanned, entry.Key+"="+entry.Value)
+	}
+
+	if len(scanned) != 4 || scanned[0] != "admin:1=value admin:1" {
+		t.Fatal("unexpected scan results", scanned)
+	}
+
+	err = sessions.SetTTL("user:expired", "gone", time.Nanosecond)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := sessions.Count("user:")
+
+	if err != nil || count != 3 {
+		t.Fatal("expected 3 user keys, got", count, err)
+	}
+
+	deleted, err := sessions.DeletePrefix("user:")
+
+	if err != nil || deleted != 4 {
+		t.Fatal("expected to delete 3 keys and the expired one, got", deleted, err)
+	}
+
+	db, err := openKV()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	remaining, err := GetSingleDB[int](db, "SELECT COUNT(*) FROM key_values WHERE namespace = 'sessions' AND row_key = 'user:expired'")
+
+	if err != nil || remaining != 0 {
+		t.Fatal("expected the expired key to be deleted, got", remaining, err)
+	}
+
+	count, err = sessions.Count("")
+
+	if err != nil || count != 1 {
+		t.Fatal("expected 1 key left, got", count, err)
+	}
+
+	if GetValue("user:1") != "default namespace" {
+		t.Fatal("expected DeletePrefix to leave other namespaces alone")
+	}
+}
+
+func TestKVScanPages(t *testing.T) {
+	pages := KV("pages")
+
+	for i := range scanPageSize + 10 {
+		err := pages.Set(fmt.Sprintf("key%04d", i), "value")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := 0
+
+	for _, err := range pages.Scan("key") {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count++
+	}
+
+	if count != scanPageSize+10 {
+		t.Fatal("expected scan to cross pages, got", count)
+	}
+}
+
+func TestKVAtomic(t *testing.T) {
+	atomic := KV("atomic")
+
+	_, err := atomic.DeletePrefix("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	numWorkers := 10
+	numIncrements := 10
+
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+
+	for range numWorkers {
+		go func() {
+			defer wg.Done()
+
+			for range numIncrements {
+				_, err := atomic.Increment("counter", 1)
+
+				if err != nil {
+					panic(err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	total, err := atomic.Increment("counter", 0)
+
+	if err != nil || total != int64(numWorkers*numIncrements) {
+		t.Fatal("expected no lost increments, got", total, err)
+	}
+
+	for key, value := range map[string]string{"text": "hello", "real": "1.5"} {
+		err = atomic.Set(key, value)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = atomic.Increment(key, 5)
+
+		if err == nil {
+			t.Fatalf("expected incrementing %q to fail", value)
+		}
+
+		stored, _, err := atomic.Get(key)
+
+		if err != nil || stored != value {
+			t.Fatalf("expected %q to be left unchanged, got %q %v", value, stored, err)
+		}
+	}
+
+	set, err := atomic.SetIfAbsent("leader", "a")
+
+	if err != nil || !set {
+		t.Fatal("expected first SetIfAbsent to succeed", set, err)
+	}
+
+	set, err = atomic.SetIfAbsent("leader", "b")
+
+	if err != nil || set {
+		t.Fatal("expected second SetIfAbsent to fail", set, err)
+	}
+
+	swapped, err := atomic.CompareAndSwap("leader", "b", "c")
+
+	if err != nil || swapped {
+		t.Fatal("expected swap from the wrong value to fail", swapped, err)
+	}
+
+	swapped, err = atomic.CompareAndSwap("leader", "a", "c")
+
+	if err != nil || !swapped {
+		t.Fatal("expected swap to succeed", swapped, err)
+	}
+
+	value, ok, err := atomic.GetAndDelete("leader")
+
+	if err != nil || !ok || value != "c" {
+		t.Fatal("expected to get and delete c, got", value, ok, err)
+	}
+
+	_, ok, err = atomic.GetAndDelete("leader")
+
+	if err != nil || ok {
+		t.Fatal("expected key to be gone", ok, err)
+	}
+
+	set, err = atomic.SetIfAbsentTTL("lease", "a", time.Millisecond)
+
+	if err != nil || !set {
+		t.Fatal("expected lease to be set", set, err)
+	}
+
+	time.Sleep(time.Millisecond * 5)
+
+	set, err = atomic.SetIfAbsent("lease", "b")
+
+	if err != nil || !set {
+		t.Fatal("expected an expired lease to be taken over", set, err)
+	}
+}
+
+func TestKVBatch(t *testing.T) {
+	config := KV("config")
+
+	values := map[string]string{}
+
+	for i := range 5000 {
+		values[fmt.Sprintf("setting%04d", i)] = fmt.Sprint(i)
+	}
+
+	start := time.Now()
+
+	err := config.SetMany(values)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Fatal("SetMany took", time.Since(start))
+	}
+
+	got, err := config.GetMany([]string{"setting0001", "setting4999", "missing"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 || got["setting0001"] != "1" || got["setting4999"] != "4999" {
+		t.Fatal("unexpected GetMany results", got)
+	}
+
+	err = SetManyOf(config, map[string][]int{"ok": {1}, "bad": nil})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = SetManyOf(config, map[string]any{"first": 1, "unencodable": make(chan int)})
+
+	if err == nil {
+		t.Fatal("expected an encoding error")
+	}
+
+	has, err := config.Has("first")
+
+	if err != nil || has {
+		t.Fatal("expected SetManyOf to roll back", has, err)
+	}
+
+	deleted, err := config.DeleteMany([]string{"setting0001", "setting0002", "missing"})
+
+	if err != nil || deleted != 2 {
+		t.Fatal("expected to delete 2 keys, got", deleted, err)
+	}
+}
+
+func TestKVHistory(t *testing.T) {
+	history := KV("history")
+
+	err := history.EnableHistory(3)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = history.Set("config", "v1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 5)
+	afterFirst := time.Now()
+	time.Sleep(time.Millisecond * 5)
+
+	for _, value := range []string{"v2", "v3", "v4"} {
+		err = history.Set("config", value)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := history.History("config")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 3 || versions[0].Version != 2 || versions[2].Value != "v4" {
+		t.Fatal("expected the latest 3 versions to be retained, got", versions)
+	}
+
+	err = history.Rollback("config", 3)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, _, err := history.Get("config")
+
+	if err != nil || value != "v3" {
+		t.Fatal("expected rollback to restore v3, got", value, err)
+	}
+
+	err = history.Rollback("config", 1)
+
+	if err == nil {
+		t.Fatal("expected an error rolling back to a version past retention")
+	}
+
+	value, ok, err := history.GetValueAt("config", afterFirst)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok {
+		t.Fatal("expected trimmed history not to answer for early times, got", value)
+	}
+
+	value, ok, err = history.GetValueAt("config", time.Now())
+
+	if err != nil || !ok || value != "v3" {
+		t.Fatal("expected the current value, got", value, ok, err)
+	}
+
+	err = history.Delete("config")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok, err = history.GetValueAt("config", time.Now())
+
+	if err != nil || ok {
+		t.Fatal("expected the key to be recorded as deleted", ok, err)
+	}
+
+	err = KV("no-history").Set("config", "v1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err = KV("no-history").History("config")
+
+	if err != nil || len(versions) != 0 {
+		t.Fatal("expected no history without opting in", versions, err)
+	}
+}
+
+func TestAttachedKV(t *testing.T) {
+	db, err := OpenActiveDB()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	_, err = AttachKV(db, "bad name")
+
+	if err == nil {
+		t.Fatal("expected an invalid table name to be rejected")
+	}
+
+	kv, err := AttachKV(db, "app_settings")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = CreateTableDB[Item](db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, commit := range []bool{false, true} {
+		tx, err := db.Begin()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		item := Item{0, fmt.Sprint("attached ", commit)}
+
+		err = InsertDB(tx, &item)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = kv.WithTx(tx).Set("last-item", item.Value)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exists, err := ExistsDB[Item](db, item.ID)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, ok, err := kv.Get("last-item")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exists != commit || ok != commit {
+			t.Fatal("expected the item and key to commit or roll back together", commit, exists, ok, value)
+		}
+	}
+
+	has, err := DefaultKV.Has("last-item")
+
+	if err != nil || has {
+		t.Fatal("expected the attached store to be separate from __kv.db", has, err)
+	}
+}
+
+func TestKVWatch(t *testing.T) {
+	kv := KV("watch")
+
+	err := kv.Delete("config.port")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type change struct{ key, old, new string }
+	changes := make(chan change, 10)
+
+	stop, err := kv.Watch("config.*", func(key string, old string, new string) {
+		changes <- change{key, old, new}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stop()
+
+	expect := func(want change) {
+		select {
+		case got := <-changes:
+			if got != want {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %v, got nothing", want)
+		}
+	}
+
+	writes := []func() error{
+		func() error { return kv.Set("config.port", "80") },
+		func() error { return kv.Set("other", "ignored") },
+		func() error { return KV("elsewhere").Set("config.port", "ignored") },
+		func() error { return kv.Set("config.port", "80") }, // Unchanged
+		func() error { return kv.Set("config.port", "8080") },
+		func() error { return kv.Delete("config.port") },
+	}
+
+	for _, write := range writes {
+		err = write()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect(change{"config.port", "", "80"})
+	expect(change{"config.port", "80", "8080"})
+	expect(change{"config.port", "8080", ""})
+
+	stop()
+
+	err = kv.Set("config.port", "after stop")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	if len(changes) != 0 {
+		t.Fatalf("expected no changes after stop, got %v", <-changes)
+	}
+}
+
+func TestKVWatchMemory(t *testing.T) {
+	db, err := OpenMemory("kv-watch")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	kv, err := AttachKV(db, "settings")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan string, 10)
+
+	stop, err := kv.Watch("theme", func(key string, old string, new string) { changes <- new })
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stop()
+
+	err = kv.Set("theme", "dark")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case value := <-changes:
+		if value != "dark" {
+			t.Fatal("expected the new value, got", value)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the change to an in-memory store to be seen")
+	}
+}
+
+func TestKVWatchSkipsOtherKeys(t *testing.T) {
+	kv := KV("watch")
+
+	db, err := openKV()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	conn := kvConn{db, defaultKVTable}
+
+	err = kv.Set("unwatched", fmt.Sprint(time.Now().UnixNano()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := GetSingleDB[int64](conn, "SELECT MAX(seq) FROM key_values_changes")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	condition, args := kv.watchCondition("watched")
+
+	last, err := deliverKVChanges(conn, condition, args, latest-1, func(key string, old string, new string) {
+		t.Fatal("expected no matching changes, got", key)
+	})
+
+	if err != nil || last != latest {
+		t.Fatalf("expected to move past changes to other keys, to %d, got %d %v", latest, last, err)
 	}
 }
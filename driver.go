@@ -0,0 +1,144 @@
+package dbdt
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"reflect"
+)
+
+// Wraps each connection dbConnector opens. Commits and write errors only happen as a statement runs, so every
+// path that runs one ends in done.
+type dbConn struct {
+	driver.Conn
+	changes  *connChanges
+	readOnly bool   // Translate write errors to ErrReadOnly
+	path     string // See dbConnector
+}
+
+// Called as each driver call returns
+func (conn dbConn) done(err error) error {
+	conn.changes.publish()
+
+	if conn.readOnly {
+		return readOnlyError(err)
+	}
+
+	return err
+}
+
+// Called as each statement returns, with the number of pending changes from before it ran
+func (conn dbConn) ran(mark int, err error) error {
+	if err != nil && err != io.EOF {
+		conn.changes.statementFailed(mark)
+	}
+
+	return conn.done(err)
+}
+
+func (conn dbConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := conn.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+
+	if err != nil {
+		return nil, conn.done(err)
+	}
+
+	return dbStmt{stmt, conn}, nil
+}
+
+func (conn dbConn) BeginTx(ctx context.Context, options driver.TxOptions) (driver.Tx, error) {
+	tx, err := conn.Conn.(driver.ConnBeginTx).BeginTx(ctx, options)
+
+	if err != nil {
+		return nil, conn.done(err)
+	}
+
+	return dbTx{tx, conn}, nil
+}
+
+func (conn dbConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	mark := len(conn.changes.pending)
+	res, err := conn.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+
+	return res, conn.ran(mark, err)
+}
+
+func (conn dbConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	mark := len(conn.changes.pending)
+	rows, err := conn.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+
+	if err != nil {
+		return nil, conn.ran(mark, err)
+	}
+
+	return dbRows{rows, conn, mark}, nil
+}
+
+func (conn dbConn) Ping(ctx context.Context) error {
+	return conn.Conn.(driver.Pinger).Ping(ctx)
+}
+
+type dbStmt struct {
+	driver.Stmt
+	conn dbConn
+}
+
+func (stmt dbStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	mark := len(stmt.conn.changes.pending)
+	res, err := stmt.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+
+	return res, stmt.conn.ran(mark, err)
+}
+
+func (stmt dbStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	mark := len(stmt.conn.changes.pending)
+	rows, err := stmt.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+
+	if err != nil {
+		return nil, stmt.conn.ran(mark, err)
+	}
+
+	return dbRows{rows, stmt.conn, mark}, nil
+}
+
+type dbTx struct {
+	driver.Tx
+	conn dbConn
+}
+
+func (tx dbTx) Commit() error {
+	return tx.conn.done(tx.Tx.Commit())
+}
+
+func (tx dbTx) Rollback() error {
+	return tx.conn.done(tx.Tx.Rollback())
+}
+
+// A statement outside a transaction, such as an INSERT ... RETURNING, commits when its rows finish
+type dbRows struct {
+	driver.Rows
+	conn dbConn
+	mark int // Pending changes from before the statement, a failing step undoes the whole statement
+}
+
+func (rows dbRows) Next(dest []driver.Value) error {
+	return rows.conn.ran(rows.mark, rows.Rows.Next(dest))
+}
+
+func (rows dbRows) Close() error {
+	return rows.conn.done(rows.Rows.Close())
+}
+
+// Column types are forwarded, since database/sql only finds them on the rows it is given
+
+func (rows dbRows) ColumnTypeDatabaseTypeName(index int) string {
+	return rows.Rows.(driver.RowsColumnTypeDatabaseTypeName).ColumnTypeDatabaseTypeName(index)
+}
+
+func (rows dbRows) ColumnTypeScanType(index int) reflect.Type {
+	return rows.Rows.(driver.RowsColumnTypeScanType).ColumnTypeScanType(index)
+}
+
+func (rows dbRows) ColumnTypeNullable(index int) (nullable bool, ok bool) {
+	return rows.Rows.(driver.RowsColumnTypeNullable).ColumnTypeNullable(index)
+}
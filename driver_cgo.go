@@ -0,0 +1,24 @@
+//go:build cgo
+
+package dbdt
+
+import (
+	"database/sql/driver"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func sqliteConn(conn driver.Conn) *sqlite3.SQLiteConn {
+	return conn.(*sqlite3.SQLiteConn)
+}
+
+func connFilename(conn *sqlite3.SQLiteConn, database string) string {
+	return conn.GetFilename(database)
+}
+
+func isReadOnlyError(err error) bool {
+	sqliteErr := sqlite3.Error{}
+
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrReadonly
+}
@@ -0,0 +1,23 @@
+//go:build !cgo
+
+package dbdt
+
+import (
+	"database/sql/driver"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// go-sqlite3 cannot open databases without cgo, so these are never called
+
+func sqliteConn(conn driver.Conn) *sqlite3.SQLiteConn {
+	return nil
+}
+
+func connFilename(conn *sqlite3.SQLiteConn, database string) string {
+	return ""
+}
+
+func isReadOnlyError(err error) bool {
+	return false
+}
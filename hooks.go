@@ -0,0 +1,52 @@
+package dbdt
+
+// Entities can implement these (usually on the pointer receiver) to run code around dbdt operations.
+// Returning an error aborts the operation, batch operations are rolled back.
+
+type BeforeInserter interface {
+	BeforeInsert() error
+}
+
+type AfterInserter interface {
+	AfterInsert() error
+}
+
+type BeforeUpdater interface {
+	BeforeUpdate() error
+}
+
+type AfterLoader interface {
+	AfterLoad() error
+}
+
+func callBeforeInsert(entity any) error {
+	if hook, ok := entity.(BeforeInserter); ok {
+		return hook.BeforeInsert()
+	}
+
+	return nil
+}
+
+func callAfterInsert(entity any) error {
+	if hook, ok := entity.(AfterInserter); ok {
+		return hook.AfterInsert()
+	}
+
+	return nil
+}
+
+func callBeforeUpdate(entity any) error {
+	if hook, ok := entity.(BeforeUpdater); ok {
+		return hook.BeforeUpdate()
+	}
+
+	return nil
+}
+
+func callAfterLoad(entity any) error {
+	if hook, ok := entity.(AfterLoader); ok {
+		return hook.AfterLoad()
+	}
+
+	return nil
+}
@@ -1,112 +1,639 @@
 package dbdt
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 const kvDB = "__kv.db"
 
 var kvDBPath = filepath.Join(".", kvDB)
 
+var kvLogger = log.Default()
+
+// Used by SetValue and GetValue, which have no error to return. A nil logger discards errors.
+func SetKVLogger(logger *log.Logger) {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+
+	kvLogger = logger
+}
+
 func logError(err error) {
-	log.Printf("Error with %v, %v", kvDBPath, err)
+	kvLogger.Printf("Error with %v, %v", kvDBPath, err)
 }
 
-func initKV() error {
-	if activeFolder == "" {
-		return errors.New("cannot use KV functions, activeFolder not set")
+// The primary key doubles as the index for prefix range queries within a namespace.
+// row_value has no declared type, so values keep the type they were stored with, "007" is not turned into 7.
+const createKVTable = `CREATE TABLE IF NOT EXISTS key_values (
+	namespace TEXT NOT NULL DEFAULT '',
+	row_key TEXT NOT NULL,
+	row_value,
+	expires_at INTEGER,
+	PRIMARY KEY (namespace, row_key)
+)`
+
+// Queries are written against key_values, and rewritten for stores attached under another table name.
+// Related tables and triggers (key_values_history etc.) are renamed along with it.
+const defaultKVTable = "key_values"
+
+// Table names that can be used in queries without quoting
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type kvConn struct {
+	DBTX
+	table string
+}
+
+func (conn kvConn) rewrite(query string) string {
+	if conn.table == defaultKVTable {
+		return query
 	}
 
-	if kvDBPath == "" {
-		return errors.New("KV db path not set")
+	return strings.ReplaceAll(query, defaultKVTable, conn.table)
+}
+
+func (conn kvConn) Exec(query string, args ...any) (sql.Result, error) {
+	return conn.DBTX.Exec(conn.rewrite(query), args...)
+}
+
+func (conn kvConn) Query(query string, args ...any) (*sql.Rows, error) {
+	return conn.DBTX.Query(conn.rewrite(query), args...)
+}
+
+func (conn kvConn) QueryRow(query string, args ...any) *sql.Row {
+	return conn.DBTX.QueryRow(conn.rewrite(query), args...)
+}
+
+func (conn kvConn) Prepare(query string) (*sql.Stmt, error) {
+	return conn.DBTX.Prepare(conn.rewrite(query))
+}
+
+// Runs apply in a transaction on the underlying connection (or a savepoint if it is already a transaction)
+func (conn kvConn) transaction(apply func(conn kvConn) error) error {
+	transaction, err := begin(conn.DBTX)
+
+	if err != nil {
+		return err
 	}
 
-	kvDBPath = filepath.Join(activeFolder, kvDB)
+	err = apply(kvConn{transaction, conn.table})
+
+	if err != nil {
+		transaction.Rollback()
+		return err
+	}
 
-	query := "CREATE TABLE IF NOT EXISTS key_values (row_key TEXT PRIMARY KEY, row_value ANY)"
+	return transaction.Commit()
+}
 
-	db, err := OpenDB(kvDBPath)
+func initKVTables(conn kvConn) error {
+	err := ExecDB(conn, createKVTable)
 
 	if err != nil {
 		return err
 	}
 
-	err = ExecDB(db, query)
+	return migrateKVTables(conn)
+}
+
+func initKV(dbPath string) error {
+	db, err := OpenDB(dbPath)
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	defer db.Close()
+
+	return initKVTables(kvConn{db, defaultKVTable})
+}
+
+// Brings a key_values table created by an older version of dbdt up to date, this runs automatically when the KV store is opened
+func MigrateKVDB(db DBTX) error {
+	return migrateKVTables(kvConn{db, defaultKVTable})
 }
 
-var initialised = false
+func migrateKVTables(conn kvConn) error {
+	columns, err := GetColumnDB[string](conn, "SELECT name FROM pragma_table_info('key_values')")
 
-func checkInit() {
-	if initialised {
-		return
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(columns, "expires_at") {
+		err = ExecDB(conn, "ALTER TABLE key_values ADD COLUMN expires_at INTEGER")
+
+		if err != nil {
+			return err
+		}
 	}
 
-	err := initKV()
+	valueType, err := GetSingleDB[string](conn, "SELECT type FROM pragma_table_info('key_values') WHERE name = 'row_value'")
 
 	if err != nil {
-		logError(err)
-		return
+		return err
+	}
+
+	if !slices.Contains(columns, "namespace") || valueType != "" {
+		err = rebuildKVTable(conn, slices.Contains(columns, "namespace"))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = untypeKVValues(conn, "key_values_history", createKVHistory[0])
+
+	if err != nil {
+		return err
 	}
 
-	initialised = true
+	err = createKVHistoryTables(conn)
+
+	if err != nil {
+		return err
+	}
+
+	err = untypeKVValues(conn, "key_values_changes", createKVChanges[0])
+
+	if err != nil {
+		return err
+	}
+
+	return createKVChangeTables(conn)
 }
 
-func SetValue(key string, value string) {
-	checkInit()
+// SQLite cannot change the primary key (to add namespace) or a column's type in place, so the table is rebuilt.
+// Strings an older table already stored as numbers stay numbers.
+func rebuildKVTable(conn kvConn, hasNamespace bool) error {
+	columns := "row_key, row_value, expires_at"
+
+	if hasNamespace {
+		columns = "namespace, " + columns
+	}
+
+	queries := []string{
+		"ALTER TABLE key_values RENAME TO key_values_old",
+		createKVTable,
+		"INSERT INTO key_values (" + columns + ") SELECT " + columns + " FROM key_values_old",
+		"DROP TABLE key_values_old",
+	}
+
+	return conn.transaction(func(conn kvConn) error {
+		for _, query := range queries {
+			_, err := conn.Exec(query)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Older versions declared the history and change log values ANY, which turns "007" into 7 like key_values did.
+// The table is rebuilt without its triggers, which are named after it, and they are recreated afterwards.
+func untypeKVValues(conn kvConn, table string, create string) error {
+	types, err := GetColumnDB[string](conn, fmt.Sprintf(
+		"SELECT type FROM pragma_table_info('%s') WHERE name IN ('row_value', 'old_value', 'new_value')", table))
+
+	if err != nil {
+		return err
+	}
+
+	if !slices.ContainsFunc(types, func(valueType string) bool { return valueType != "" }) {
+		return nil
+	}
+
+	queries := []string{}
+
+	for _, trigger := range []string{"insert", "update", "delete"} {
+		queries = append(queries, "DROP TRIGGER IF EXISTS "+table+"_"+trigger)
+	}
+
+	queries = append(queries,
+		"ALTER TABLE "+table+" RENAME TO "+table+"_old",
+		create,
+		"INSERT INTO "+table+" SELECT * FROM "+table+"_old",
+		"DROP TABLE "+table+"_old",
+	)
+
+	return conn.transaction(func(conn kvConn) error {
+		for _, query := range queries {
+			_, err := conn.Exec(query)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Replacing an existing key updates its row, rather than deleting and reinserting it, so triggers see the old value
+const upsertKV = `INSERT INTO key_values (namespace, row_key, row_value, expires_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT (namespace, row_key) DO UPDATE SET row_value = excluded.row_value, expires_at = excluded.expires_at`
+
+// Expiry times are stored as unix nanoseconds, NULL never expires
+const notExpired = "(expires_at IS NULL OR expires_at > ?)"
+
+func nowNano() int64 {
+	return time.Now().UnixNano()
+}
+
+var initialisedPath = ""
+var initLock sync.Mutex
+
+// Opens __kv.db in the active folder, creating the table the first time each folder is used
+func openKV() (*sql.DB, error) {
+	if activeFolder == "" {
+		return nil, errors.New("cannot use KV functions, activeFolder not set")
+	}
+
+	initLock.Lock()
+	defer initLock.Unlock()
+
+	kvDBPath = filepath.Join(activeFolder, kvDB)
+
+	if initialisedPath != kvDBPath {
+		err := initKV(kvDBPath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		initialisedPath = kvDBPath
+	}
+
+	return OpenDB(kvDBPath)
+}
+
+// Key value access that returns errors, rather than logging them like SetValue and GetValue.
+// Each store is a namespace, keys in different namespaces do not collide.
+type KVStore struct {
+	db        DBTX // Nil opens __kv.db in the active folder for each call
+	table     string
+	namespace string
+	path      string // What db was opened with, if it was opened by this package, so Watch can open it too
+}
+
+// The default namespace in __kv.db, used by SetValue and GetValue
+var DefaultKV = &KVStore{nil, defaultKVTable, "", ""}
+
+// A namespace in __kv.db
+func KV(namespace string) *KVStore {
+	return &KVStore{nil, defaultKVTable, namespace, ""}
+}
+
+// Keeps keys in table within db, creating or migrating the table if needed. Attaching to the database that holds
+// the entity tables lets KV writes share a transaction with CRUD writes, see WithTx.
+func AttachKV(db DBTX, table string) (*KVStore, error) {
+	if !identifierPattern.MatchString(table) {
+		return nil, fmt.Errorf("invalid KV table name %q", table)
+	}
+
+	err := initKVTables(kvConn{db, table})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &KVStore{db, table, "", openedPath(db)}, nil
+}
+
+// The path db was opened with, "" if it is not a *sql.DB from this package. In-memory databases have no file
+// to look up, so this is the only way to find them again.
+func openedPath(db DBTX) string {
+	pool, ok := db.(*sql.DB)
+
+	if !ok {
+		return ""
+	}
+
+	conn, err := pool.Conn(context.Background())
+
+	if err != nil {
+		return ""
+	}
+
+	defer conn.Close()
+
+	path := ""
+
+	conn.Raw(func(driverConn any) error {
+		opened, ok := driverConn.(dbConn)
+
+		if ok {
+			path = opened.path
+		}
 
-	query := "INSERT OR REPLACE INTO key_values (row_key, row_value) VALUES (?, ?)"
+		return nil
+	})
 
-	db, err := OpenDB(kvDBPath)
+	return path
+}
+
+// The same table, in another namespace
+func (kv *KVStore) WithNamespace(namespace string) *KVStore {
+	return &KVStore{kv.db, kv.table, namespace, kv.path}
+}
+
+// The same table and namespace, read and written through db, typically a *sql.Tx on the attached database.
+// The table must already exist.
+func (kv *KVStore) WithTx(db DBTX) *KVStore {
+	return &KVStore{db, kv.table, kv.namespace, kv.path}
+}
+
+func (kv *KVStore) Namespace() string {
+	return kv.namespace
+}
+
+func (kv *KVStore) open() (kvConn, func(), error) {
+	if kv.db != nil {
+		return kvConn{kv.db, kv.table}, func() {}, nil
+	}
+
+	db, err := openKV()
+
+	if err != nil {
+		return kvConn{}, nil, err
+	}
+
+	return kvConn{db, kv.table}, func() { db.Close() }, nil
+}
+
+// A nil expiresAt never expires
+func (kv *KVStore) setEncoded(key string, value any, expiresAt any) error {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	return ExecDB(db, upsertKV, kv.namespace, key, value, expiresAt)
+}
+
+func getValueOfKV[T any](kv *KVStore, key string) (T, bool, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return *new(T), false, err
+	}
+
+	defer release()
+
+	query := "SELECT row_value FROM key_values WHERE namespace = ? AND row_key = ? AND " + notExpired + " LIMIT 1"
+
+	return decodeKVRow[T](db.QueryRow(query, kv.namespace, key, nowNano()))
+}
+
+func (kv *KVStore) Set(key string, value string) error {
+	return kv.setEncoded(key, value, nil)
+}
+
+// The bool is false if the key does not exist
+func (kv *KVStore) Get(key string) (string, bool, error) {
+	return getValueOfKV[string](kv, key)
+}
+
+// The key expires after ttl, and is then treated as missing until swept
+func (kv *KVStore) SetTTL(key string, value string, ttl time.Duration) error {
+	return kv.setEncoded(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// The remaining time before the key expires, or 0 if it never expires. The bool is false if the key does not exist.
+func (kv *KVStore) TTL(key string) (time.Duration, bool, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	defer release()
+
+	now := nowNano()
+
+	query := "SELECT expires_at FROM key_values WHERE namespace = ? AND row_key = ? AND " + notExpired + " LIMIT 1"
+
+	expiresAt := sql.NullInt64{}
+
+	err = db.QueryRow(query, kv.namespace, key, now).Scan(&expiresAt)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	if !expiresAt.Valid {
+		return 0, true, nil
+	}
+
+	return time.Duration(expiresAt.Int64 - now), true, nil
+}
+
+// Returns the number of expired keys removed from the namespace
+func (kv *KVStore) DeleteExpired() (int64, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer release()
+
+	res, err := db.Exec("DELETE FROM key_values WHERE namespace = ? AND expires_at <= ?", kv.namespace, nowNano())
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// Deletes expired keys every interval until stop is called, errors go to the KV logger
+func (kv *KVStore) StartSweeper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := kv.DeleteExpired()
+
+				if err != nil {
+					logError(err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
+
+func (kv *KVStore) Delete(key string) error {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	return ExecDB(db, "DELETE FROM key_values WHERE namespace = ? AND row_key = ?", kv.namespace, key)
+}
+
+func (kv *KVStore) Has(key string) (bool, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return false, err
+	}
+
+	defer release()
+
+	query := "SELECT EXISTS (SELECT 1 FROM key_values WHERE namespace = ? AND row_key = ? AND " + notExpired + ")"
+
+	return GetSingleDB[bool](db, query, kv.namespace, key, nowNano())
+}
+
+func SetValue(key string, value string) {
+	err := DefaultKV.Set(key, value)
 
 	if err != nil {
 		logError(err)
-		return
 	}
+}
 
-	err = ExecDB(db, query, key, value)
+func SetValueTTL(key string, value string, ttl time.Duration) {
+	err := DefaultKV.SetTTL(key, value, ttl)
 
 	if err != nil {
 		logError(err)
-		return
 	}
 }
 
+// Returns "" if the key does not exist, use DefaultKV.Get to tell a missing key from an empty value
 func GetValue(key string) string {
-	checkInit()
-
 	if key == "" {
 		return ""
 	}
 
-	db, err := OpenDB(kvDBPath)
+	value, _, err := DefaultKV.Get(key)
 
 	if err != nil {
 		logError(err)
 		return ""
 	}
 
-	query := "SELECT row_value FROM key_values WHERE row_key = ? LIMIT 1"
+	return value
+}
 
-	value, err := GetSingleDB[string](db, query, key)
+func SetValueOf[T any](key string, value T) error {
+	encoded, err := encodeKVValue(value)
 
 	if err != nil {
+		return err
+	}
+
+	return DefaultKV.setEncoded(key, encoded, nil)
+}
+
+// The bool is false if the key does not exist
+func GetValueOf[T any](key string) (T, bool, error) {
+	return getValueOfKV[T](DefaultKV, key)
+}
+
+// Structs, maps and slices (other than []byte) are stored as JSON text
+func isJSONType(valueType reflect.Type) bool {
+	switch valueType.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Array, reflect.Pointer, reflect.Interface:
+		return true
+	case reflect.Slice:
+		return valueType.Elem().Kind() != reflect.Uint8
+	}
+
+	return false
+}
+
+func encodeKVValue[T any](value T) (any, error) {
+	if !isJSONType(reflect.TypeFor[T]()) {
+		return value, nil // Scalars and []byte are stored as native SQLite values
+	}
+
+	encoded, err := json.Marshal(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return string(encoded), nil
+}
+
+func decodeKVRow[T any](row *sql.Row) (T, bool, error) {
+	value := *new(T)
+
+	if !isJSONType(reflect.TypeFor[T]()) {
+		err := row.Scan(&value) // database/sql converts between the stored and requested scalar types
+
 		if errors.Is(err, sql.ErrNoRows) {
-			// Do nothing
-		} else {
-			logError(err)
+			return value, false, nil
 		}
 
-		return ""
+		if err != nil {
+			return value, false, err
+		}
+
+		return value, true, nil
 	}
 
-	return value
+	encoded := []byte{}
+
+	err := row.Scan(&encoded)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return value, false, nil
+	}
+
+	if err != nil {
+		return value, false, err
+	}
+
+	err = json.Unmarshal(encoded, &value)
+
+	if err != nil {
+		return value, false, err
+	}
+
+	return value, true, nil
 }
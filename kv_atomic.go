@@ -0,0 +1,128 @@
+package dbdt
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Each of these is a single statement, so they are atomic across every process sharing the KV database.
+// Expired keys are treated as missing.
+
+// Adds delta to the stored integer (a missing key counts as 0) and returns the new value. Any expiry is kept.
+// The integer can have been set as a string, such as "5". A key holding anything else, including "05", is left
+// unchanged and an error is returned.
+func (kv *KVStore) Increment(key string, delta int64) (int64, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer release()
+
+	// When the WHERE rejects the existing row nothing is written and nothing is returned
+	query := `INSERT INTO key_values (namespace, row_key, row_value, expires_at) VALUES (?1, ?2, ?3, NULL)
+		ON CONFLICT (namespace, row_key) DO UPDATE SET
+			row_value = CASE WHEN expires_at <= ?4 THEN excluded.row_value ELSE row_value + excluded.row_value END,
+			expires_at = CASE WHEN expires_at <= ?4 THEN NULL ELSE expires_at END
+		WHERE expires_at <= ?4 OR typeof(row_value) = 'integer'
+			OR (typeof(row_value) = 'text' AND CAST(CAST(row_value AS INTEGER) AS TEXT) = row_value)
+		RETURNING row_value`
+
+	value := int64(0)
+
+	err = db.QueryRow(query, kv.namespace, key, delta, nowNano()).Scan(&value)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("cannot increment key %s, its value is not an integer", key)
+	}
+
+	return value, err
+}
+
+// Sets the key to new only if it currently holds old, returns whether the swap happened.
+// Values are compared as Get returns them, so a counter left by Increment matches its decimal string.
+func (kv *KVStore) CompareAndSwap(key string, old string, new string) (bool, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return false, err
+	}
+
+	defer release()
+
+	query := "UPDATE key_values SET row_value = ? WHERE namespace = ? AND row_key = ? AND CAST(row_value AS TEXT) = ? AND " + notExpired
+
+	res, err := db.Exec(query, new, kv.namespace, key, old, nowNano())
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+
+	return affected == 1, err
+}
+
+// Returns whether the value was set, false means the key already existed
+func (kv *KVStore) SetIfAbsent(key string, value string) (bool, error) {
+	return kv.setIfAbsent(key, value, nil)
+}
+
+// As SetIfAbsent, but the key expires after ttl, e.g. for a leader lease
+func (kv *KVStore) SetIfAbsentTTL(key string, value string, ttl time.Duration) (bool, error) {
+	return kv.setIfAbsent(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+func (kv *KVStore) setIfAbsent(key string, value string, expiresAt any) (bool, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return false, err
+	}
+
+	defer release()
+
+	query := `INSERT INTO key_values (namespace, row_key, row_value, expires_at) VALUES (?1, ?2, ?3, ?4)
+		ON CONFLICT (namespace, row_key) DO UPDATE SET row_value = excluded.row_value, expires_at = excluded.expires_at
+		WHERE expires_at <= ?5`
+
+	res, err := db.Exec(query, kv.namespace, key, value, expiresAt, nowNano())
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+
+	return affected == 1, err
+}
+
+// Removes the key and returns the value it held. The bool is false if the key did not exist.
+func (kv *KVStore) GetAndDelete(key string) (string, bool, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return "", false, err
+	}
+
+	defer release()
+
+	query := "DELETE FROM key_values WHERE namespace = ? AND row_key = ? AND " + notExpired + " RETURNING row_value"
+
+	value := ""
+
+	err = db.QueryRow(query, kv.namespace, key, nowNano()).Scan(&value)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	return value, true, nil
+}
@@ -0,0 +1,122 @@
+package dbdt
+
+import (
+	"database/sql"
+)
+
+// Batch operations run in one transaction with one prepared statement, so they apply all or nothing
+
+func (kv *KVStore) SetMany(values map[string]string) error {
+	return SetManyOf(kv, values)
+}
+
+// Missing keys are left out of the returned map
+func (kv *KVStore) GetMany(keys []string) (map[string]string, error) {
+	return GetManyOf[string](kv, keys)
+}
+
+// Returns the number of keys deleted
+func (kv *KVStore) DeleteMany(keys []string) (int64, error) {
+	deleted := int64(0)
+
+	err := kv.batch("DELETE FROM key_values WHERE namespace = ? AND row_key = ?", func(stmt *sql.Stmt) error {
+		for _, key := range keys {
+			res, err := stmt.Exec(kv.namespace, key)
+
+			if err != nil {
+				return err
+			}
+
+			affected, err := res.RowsAffected()
+
+			if err != nil {
+				return err
+			}
+
+			deleted += affected
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted, nil
+}
+
+// Values are stored as in SetValueOf
+func SetManyOf[V any](kv *KVStore, values map[string]V) error {
+	return kv.batch(upsertKV, func(stmt *sql.Stmt) error {
+		for key, value := range values {
+			encoded, err := encodeKVValue(value)
+
+			if err != nil {
+				return err
+			}
+
+			_, err = stmt.Exec(kv.namespace, key, encoded, nil)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Values are read as in GetValueOf, missing keys are left out of the returned map
+func GetManyOf[V any](kv *KVStore, keys []string) (map[string]V, error) {
+	values := map[string]V{}
+
+	query := "SELECT row_value FROM key_values WHERE namespace = ? AND row_key = ? AND " + notExpired + " LIMIT 1"
+
+	err := kv.batch(query, func(stmt *sql.Stmt) error {
+		now := nowNano()
+
+		for _, key := range keys {
+			value, ok, err := decodeKVRow[V](stmt.QueryRow(kv.namespace, key, now))
+
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				values[key] = value
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// Prepares query in a transaction, which is committed if apply succeeds and rolled back otherwise
+func (kv *KVStore) batch(query string, apply func(stmt *sql.Stmt) error) error {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	return db.transaction(func(conn kvConn) error {
+		stmt, err := conn.Prepare(query)
+
+		if err != nil {
+			return err
+		}
+
+		defer stmt.Close()
+
+		return apply(stmt)
+	})
+}
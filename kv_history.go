@@ -0,0 +1,213 @@
+package dbdt
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// History is recorded by triggers, so every write to an opted-in namespace is captured,
+// including batch and atomic operations and writes from other processes.
+// Deletes (and sweeps of expired keys) are recorded as versions with Deleted set.
+var createKVHistory = []string{
+	`CREATE TABLE IF NOT EXISTS key_values_history (
+		namespace TEXT NOT NULL,
+		row_key TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		row_value,
+		deleted BOOL NOT NULL DEFAULT 0,
+		changed_at INTEGER NOT NULL,
+		PRIMARY KEY (namespace, row_key, version)
+	)`,
+	// A retention of 0 keeps every version
+	`CREATE TABLE IF NOT EXISTS key_values_history_settings (
+		namespace TEXT PRIMARY KEY,
+		retention INTEGER NOT NULL
+	)`,
+	kvHistoryTrigger("insert", "AFTER INSERT", "NEW", "NEW.row_value", "0"),
+	kvHistoryTrigger("update", "AFTER UPDATE OF row_value", "NEW", "NEW.row_value", "0"),
+	kvHistoryTrigger("delete", "AFTER DELETE", "OLD", "NULL", "1"),
+}
+
+func kvHistoryTrigger(name string, event string, row string, value string, deleted string) string {
+	thisKey := fmt.Sprintf("namespace = %[1]s.namespace AND row_key = %[1]s.row_key", row)
+	latestVersion := "(SELECT MAX(version) FROM key_values_history WHERE " + thisKey + ")"
+	retention := fmt.Sprintf("(SELECT retention FROM key_values_history_settings WHERE namespace = %s.namespace)", row)
+
+	return fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS key_values_history_%s %s ON key_values
+		WHEN EXISTS (SELECT 1 FROM key_values_history_settings WHERE namespace = %s.namespace)
+		BEGIN
+			INSERT INTO key_values_history (namespace, row_key, version, row_value, deleted, changed_at)
+			VALUES (%s.namespace, %s.row_key, COALESCE(%s, 0) + 1, %s, %s, CAST(unixepoch('subsec') * 1000000000 AS INTEGER));
+
+			DELETE FROM key_values_history WHERE %s AND %s > 0 AND version <= %s - %s;
+		END`,
+		name, event, row,
+		row, row, latestVersion, value, deleted,
+		thisKey, retention, latestVersion, retention)
+}
+
+func createKVHistoryTables(conn kvConn) error {
+	for _, query := range createKVHistory {
+		err := ExecDB(conn, query)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type KVVersion struct {
+	Version   int64
+	Value     string
+	Deleted   bool
+	ChangedAt time.Time
+}
+
+// Starts recording every change to keys in this namespace, keeping the latest retention versions of each key (0 keeps all)
+func (kv *KVStore) EnableHistory(retention int) error {
+	if retention < 0 {
+		return errors.New("history retention cannot be negative")
+	}
+
+	db, release, err := kv.open()
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	query := "INSERT OR REPLACE INTO key_values_history_settings (namespace, retention) VALUES (?, ?)"
+
+	return ExecDB(db, query, kv.namespace, retention)
+}
+
+// Stops recording changes, existing history is kept
+func (kv *KVStore) DisableHistory() error {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	return ExecDB(db, "DELETE FROM key_values_history_settings WHERE namespace = ?", kv.namespace)
+}
+
+// Recorded versions of the key, oldest first
+func (kv *KVStore) History(key string) ([]KVVersion, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	query := `SELECT version, row_value, deleted, changed_at FROM key_values_history
+		WHERE namespace = ? AND row_key = ? ORDER BY version`
+
+	rows, err := db.Query(query, kv.namespace, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	versions := []KVVersion{}
+
+	for rows.Next() {
+		version, err := scanKVVersion(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+func scanKVVersion(row interface{ Scan(dest ...any) error }) (KVVersion, error) {
+	version := KVVersion{}
+	value := sql.NullString{}
+	changedAt := int64(0)
+
+	err := row.Scan(&version.Version, &value, &version.Deleted, &changedAt)
+
+	if err != nil {
+		return version, err
+	}
+
+	version.Value = value.String
+	version.ChangedAt = time.Unix(0, changedAt)
+
+	return version, nil
+}
+
+// The value the key held at the given time, according to its history. The bool is false if it did not exist then.
+func (kv *KVStore) GetValueAt(key string, at time.Time) (string, bool, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return "", false, err
+	}
+
+	defer release()
+
+	query := `SELECT version, row_value, deleted, changed_at FROM key_values_history
+		WHERE namespace = ? AND row_key = ? AND changed_at <= ? ORDER BY version DESC LIMIT 1`
+
+	version, err := scanKVVersion(db.QueryRow(query, kv.namespace, key, at.UnixNano()))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	if version.Deleted {
+		return "", false, nil
+	}
+
+	return version.Value, true, nil
+}
+
+// Restores the value from a recorded version, which is itself recorded as a new version
+func (kv *KVStore) Rollback(key string, version int64) error {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	query := `SELECT version, row_value, deleted, changed_at FROM key_values_history
+		WHERE namespace = ? AND row_key = ? AND version = ?`
+
+	target, err := scanKVVersion(db.QueryRow(query, kv.namespace, key, version))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no version %d recorded for key %s", version, key)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if target.Deleted {
+		return ExecDB(db, "DELETE FROM key_values WHERE namespace = ? AND row_key = ?", kv.namespace, key)
+	}
+
+	return ExecDB(db, upsertKV, kv.namespace, key, target.Value, nil)
+}
@@ -0,0 +1,155 @@
+package dbdt
+
+import (
+	"iter"
+)
+
+type KVEntry struct {
+	Key   string
+	Value string
+}
+
+// Keys are compared bytewise, so every key starting with prefix sorts between prefix and the returned bound.
+// There is no upper bound if the prefix is empty or all 0xFF bytes.
+func prefixUpperBound(prefix string) (string, bool) {
+	bound := []byte(prefix)
+
+	for i := len(bound) - 1; i >= 0; i-- {
+		if bound[i] < 0xFF {
+			bound[i]++
+			return string(bound[:i+1]), true
+		}
+	}
+
+	return "", false
+}
+
+// The WHERE condition and args matching keys in the namespace starting with prefix, expired or not
+func (kv *KVStore) prefixRange(prefix string) (string, []any) {
+	condition := "namespace = ? AND row_key >= ?"
+	args := []any{kv.namespace, prefix}
+
+	upperBound, ok := prefixUpperBound(prefix)
+
+	if ok {
+		condition += " AND row_key < ?"
+		args = append(args, upperBound)
+	}
+
+	return condition, args
+}
+
+// As prefixRange, but only unexpired keys
+func (kv *KVStore) prefixCondition(prefix string) (string, []any) {
+	condition, args := kv.prefixRange(prefix)
+
+	return condition + " AND " + notExpired, append(args, nowNano())
+}
+
+// Keys starting with prefix, in lexical order
+func (kv *KVStore) Keys(prefix string) ([]string, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	condition, args := kv.prefixCondition(prefix)
+
+	return GetColumnDB[string](db, "SELECT row_key FROM key_values WHERE "+condition+" ORDER BY row_key", args...)
+}
+
+func (kv *KVStore) Count(prefix string) (int, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer release()
+
+	condition, args := kv.prefixCondition(prefix)
+
+	return GetSingleDB[int](db, "SELECT COUNT(*) FROM key_values WHERE "+condition, args...)
+}
+
+// Returns the number of keys deleted. Expired keys are deleted too, so they cannot resurface in history or watches.
+func (kv *KVStore) DeletePrefix(prefix string) (int64, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer release()
+
+	condition, args := kv.prefixRange(prefix)
+
+	res, err := db.Exec("DELETE FROM key_values WHERE "+condition, args...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+const scanPageSize = 256
+
+// Iterates over the entries starting with prefix in lexical key order. Entries are read a page at a time,
+// so the database is not held open while the loop body runs. Iteration stops after yielding an error.
+func (kv *KVStore) Scan(prefix string) iter.Seq2[KVEntry, error] {
+	return paged(scanPageSize, func(last *KVEntry) ([]KVEntry, error) {
+		if last == nil {
+			return kv.scanPage(prefix, "", true)
+		}
+
+		return kv.scanPage(prefix, last.Key, false)
+	})
+}
+
+func (kv *KVStore) scanPage(prefix string, after string, first bool) ([]KVEntry, error) {
+	db, release, err := kv.open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	condition, args := kv.prefixCondition(prefix)
+
+	if !first {
+		condition += " AND row_key > ?"
+		args = append(args, after)
+	}
+
+	query := "SELECT row_key, row_value FROM key_values WHERE " + condition + " ORDER BY row_key LIMIT ?"
+	args = append(args, scanPageSize)
+
+	rows, err := db.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	page := []KVEntry{}
+
+	for rows.Next() {
+		entry := KVEntry{}
+
+		err = rows.Scan(&entry.Key, &entry.Value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		page = append(page, entry)
+	}
+
+	return page, rows.Err()
+}
@@ -0,0 +1,204 @@
+package dbdt
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Changes are logged by triggers, so writes from other processes are seen too. Only the latest
+// kvChangeRetention changes are kept, a watcher that falls further behind than that misses changes.
+const kvChangeRetention = 10000
+
+var createKVChanges = []string{
+	`CREATE TABLE IF NOT EXISTS key_values_changes (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		namespace TEXT NOT NULL,
+		row_key TEXT NOT NULL,
+		old_value,
+		new_value
+	)`,
+	kvChangeTrigger("insert", "AFTER INSERT", "NEW", "NULL", "NEW.row_value", ""),
+	kvChangeTrigger("update", "AFTER UPDATE OF row_value", "NEW", "OLD.row_value", "NEW.row_value",
+		"WHEN OLD.row_value IS NOT NEW.row_value"),
+	kvChangeTrigger("delete", "AFTER DELETE", "OLD", "OLD.row_value", "NULL", ""),
+}
+
+func kvChangeTrigger(name string, event string, row string, old string, new string, when string) string {
+	return fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS key_values_changes_%s %s ON key_values %s
+		BEGIN
+			INSERT INTO key_values_changes (namespace, row_key, old_value, new_value)
+			VALUES (%s.namespace, %s.row_key, %s, %s);
+
+			DELETE FROM key_values_changes WHERE seq <= (SELECT MAX(seq) FROM key_values_changes) - %d;
+		END`,
+		name, event, when,
+		row, row, old, new,
+		kvChangeRetention)
+}
+
+func createKVChangeTables(conn kvConn) error {
+	for _, query := range createKVChanges {
+		err := ExecDB(conn, query)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The file holding the store, so it can be watched
+func (kv *KVStore) databasePath() (string, error) {
+	if kv.db == nil {
+		db, err := openKV()
+
+		if err != nil {
+			return "", err
+		}
+
+		db.Close()
+
+		return kvDBPath, nil
+	}
+
+	if kv.path != "" {
+		return kv.path, nil
+	}
+
+	path, err := GetSingleDB[string](kv.db, "SELECT file FROM pragma_database_list WHERE name = 'main'")
+
+	if err != nil {
+		return "", err
+	}
+
+	if path == "" {
+		return "", errors.New("cannot watch an in-memory database not opened by OpenMemory")
+	}
+
+	return path, nil
+}
+
+// Calls fn with the old and new value whenever the key changes, or any key starting with the prefix if
+// keyOrPrefix ends in "*". Changes made by other processes are included. Missing values are passed as "",
+// expired keys are reported when they are deleted. Errors reading changes go to the KV logger.
+// Options control polling as for CreateDBWatcher. As with DBWatcher.Close, stop waits for fn to return,
+// so it must not be called from fn.
+func (kv *KVStore) Watch(keyOrPrefix string, fn func(key string, old string, new string), options ...WatcherOption) (stop func(), err error) {
+	path, err := kv.databasePath()
+
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := OpenDB(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn := kvConn{db, kv.table}
+
+	// Only changes made after Watch returns are reported
+	last, err := GetSingleDB[int64](conn, "SELECT COALESCE(MAX(seq), 0) FROM key_values_changes")
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	watcher, err := CreateDBWatcher(path, options...)
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	condition, args := kv.watchCondition(keyOrPrefix)
+
+	watcher.AddCallback(func() {
+		var err error
+		last, err = deliverKVChanges(conn, condition, args, last, fn)
+
+		if err != nil {
+			logError(err)
+		}
+	})
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			watcher.Close()
+			db.Close()
+		})
+	}, nil
+}
+
+func (kv *KVStore) watchCondition(keyOrPrefix string) (string, []any) {
+	prefix, isPrefix := strings.CutSuffix(keyOrPrefix, "*")
+
+	if !isPrefix {
+		return "namespace = ? AND row_key = ?", []any{kv.namespace, keyOrPrefix}
+	}
+
+	return kv.prefixRange(prefix)
+}
+
+// Calls fn for each matching change after seq last, in order, and returns the last seq read. That is the latest
+// change of any key, so changes to other keys are not read again on the next call.
+func deliverKVChanges(conn kvConn, condition string, args []any, last int64, fn func(key string, old string, new string)) (int64, error) {
+	latest, err := GetSingleDB[int64](conn, "SELECT COALESCE(MAX(seq), 0) FROM key_values_changes")
+
+	if err != nil {
+		return last, err
+	}
+
+	if latest <= last {
+		return last, nil
+	}
+
+	query := "SELECT row_key, old_value, new_value FROM key_values_changes WHERE seq > ? AND seq <= ? AND " + condition + " ORDER BY seq"
+
+	rows, err := conn.Query(query, append([]any{last, latest}, args...)...)
+
+	if err != nil {
+		return last, err
+	}
+
+	type change struct {
+		key      string
+		old, new sql.NullString
+	}
+
+	changes := []change{}
+
+	for rows.Next() {
+		c := change{}
+
+		err = rows.Scan(&c.key, &c.old, &c.new)
+
+		if err != nil {
+			rows.Close()
+			return last, err
+		}
+
+		changes = append(changes, c)
+	}
+
+	rows.Close()
+
+	if rows.Err() != nil {
+		return last, rows.Err()
+	}
+
+	// Read everything first, so fn can use the store without waiting on the open query
+	for _, c := range changes {
+		fn(c.key, c.old.String, c.new.String)
+	}
+
+	return latest, nil
+}
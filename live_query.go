@@ -0,0 +1,142 @@
+package dbdt
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The tables in the main database that query reads, found from the btrees its program opens
+func queryTables(db DBTX, query string, args ...any) ([]string, error) {
+	grid, err := GetGridDB(db, "EXPLAIN "+query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rootPages := []any{}
+
+	for _, row := range grid.Rows {
+		// Columns are addr, opcode, p1, p2 (root page), p3 (schema, 0 is main)
+		if row[1] == "OpenRead" && row[4] == int64(0) {
+			rootPages = append(rootPages, row[3])
+		}
+	}
+
+	tables := []string{}
+
+	if len(rootPages) == 0 {
+		return tables, nil
+	}
+
+	placeholders := strings.Repeat(", ?", len(rootPages))[2:]
+	query = "SELECT DISTINCT tbl_name FROM sqlite_schema WHERE rootpage IN (" + placeholders + ") ORDER BY tbl_name"
+
+	return GetColumnDB[string](db, query, rootPages...)
+}
+
+// Re-runs a FindAll style query whenever a table it reads changes, and calls fn with the rows added, removed
+// and changed since the last run, matched by ID. The first call, made before LiveQuery returns, reports every
+// row as added. Later calls run on the watcher's goroutine, and only when something changed.
+// Errors re-running the query are reported through the watcher's Errors.
+func LiveQuery[T any](watcher *DBWatcher, query string, fn func(added []T, removed []T, changed []T), args ...any) (stop func(), err error) {
+	idField, ok := reflect.TypeFor[T]().FieldByName("ID")
+
+	if !ok {
+		return nil, fmt.Errorf("%s has no ID to match rows by", reflect.TypeFor[T]().Name())
+	}
+
+	queryArgs, _ := splitQueryOptions(args)
+
+	tables, err := queryTables(watcher.db, query, queryArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tables) == 0 {
+		return nil, errors.New("live query does not read any tables")
+	}
+
+	lock := sync.Mutex{}
+	previous := []T{}
+
+	refresh := func() error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		current, err := FindAllDB[T](watcher.db, query, args...)
+
+		if err != nil {
+			return err
+		}
+
+		added, removed, changed := diffByID(previous, current, idField.Index)
+		previous = current
+
+		if len(added) > 0 || len(removed) > 0 || len(changed) > 0 {
+			fn(added, removed, changed)
+		}
+
+		return nil
+	}
+
+	unsubscribe, err := watcher.WatchTables(func() {
+		err := refresh()
+
+		if err != nil {
+			watcher.reportError(err)
+		}
+	}, tables...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = refresh()
+
+	if err != nil {
+		unsubscribe()
+		return nil, err
+	}
+
+	return unsubscribe, nil
+}
+
+// Rows are compared by value, so any changed column counts. Added and changed keep current's order.
+func diffByID[T any](previous []T, current []T, idIndex []int) (added []T, removed []T, changed []T) {
+	id := func(entity T) any {
+		return reflect.ValueOf(entity).FieldByIndex(idIndex).Interface()
+	}
+
+	previousByID := map[any]T{}
+
+	for _, entity := range previous {
+		previousByID[id(entity)] = entity
+	}
+
+	added, removed, changed = []T{}, []T{}, []T{}
+	currentIDs := map[any]bool{}
+
+	for _, entity := range current {
+		entityID := id(entity)
+		currentIDs[entityID] = true
+
+		old, existed := previousByID[entityID]
+
+		if !existed {
+			added = append(added, entity)
+		} else if !reflect.DeepEqual(old, entity) {
+			changed = append(changed, entity)
+		}
+	}
+
+	removed = slices.DeleteFunc(slices.Clone(previous), func(entity T) bool {
+		return currentIDs[id(entity)]
+	})
+
+	return added, removed, changed
+}
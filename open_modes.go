@@ -0,0 +1,65 @@
+package dbdt
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Returned, wrapping the driver's error, when a database opened with OpenReadOnly is written to
+var ErrReadOnly = errors.New("database is read-only")
+
+// SQLite URIs treat ?, # and % specially, so they are escaped in the path
+func fileURI(dbPath string) string {
+	return "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(dbPath)
+}
+
+// Opens an existing database for reading. Writes, including through the CRUD and KV functions, fail with ErrReadOnly.
+func OpenReadOnly(dbPath string, options ...OpenOption) (*sql.DB, error) {
+	applied, err := applyOpenOptions(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	applied.params.Set("mode", "ro")
+
+	return sql.OpenDB(&dbConnector{path: dbPath, dsn: applied.dsn(fileURI(dbPath)), pragmas: applied.pragmas, readOnly: true}), nil
+}
+
+// A path for OpenDB, SetActiveDBPath or CreateDBWatcher naming a shared in-memory database.
+// The database only exists while a connection to it is open, see OpenMemory.
+func MemoryPath(name string) string {
+	return fileURI(name) + "?mode=memory&cache=shared"
+}
+
+// Opens the in-memory database called name, creating it if needed. It stays alive until the returned database
+// is closed, so other connections to MemoryPath(name), such as the package-level functions or a watcher, share it.
+func OpenMemory(name string, options ...OpenOption) (*sql.DB, error) {
+	applied, err := applyOpenOptions(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	connector := &dbConnector{path: MemoryPath(name), dsn: applied.dsn(MemoryPath(name)), pragmas: applied.pragmas}
+
+	// The pool can close idle connections, so one is held outside it
+	connector.keepAlive, err = connector.Connect(context.Background())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sql.OpenDB(connector), nil
+}
+
+func readOnlyError(err error) error {
+	if isReadOnlyError(err) {
+		return fmt.Errorf("%w: %w", ErrReadOnly, err)
+	}
+
+	return err
+}
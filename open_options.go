@@ -0,0 +1,166 @@
+package dbdt
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+type OpenOption func(*openOptions)
+
+type openOptions struct {
+	params  url.Values // go-sqlite3 DSN parameters, applied by the driver to each connection it opens
+	pragmas []string   // Settings the DSN cannot express, run on each new connection
+	err     error
+}
+
+type SynchronousMode string
+
+const (
+	SynchronousOff    SynchronousMode = "OFF"
+	SynchronousNormal SynchronousMode = "NORMAL"
+	SynchronousFull   SynchronousMode = "FULL"
+	SynchronousExtra  SynchronousMode = "EXTRA"
+)
+
+// Write-ahead logging, so readers do not block the writer. Synchronous becomes NORMAL unless set with WithSynchronous.
+func WithWAL() OpenOption {
+	return func(options *openOptions) {
+		options.params.Set("_journal_mode", "WAL")
+	}
+}
+
+// How long to wait for another connection's lock before failing with "database is locked", 5s by default
+func WithBusyTimeout(timeout time.Duration) OpenOption {
+	return func(options *openOptions) {
+		if timeout < 0 {
+			options.err = errors.New("busy timeout cannot be negative")
+			return
+		}
+
+		options.params.Set("_busy_timeout", fmt.Sprint(timeout.Milliseconds()))
+	}
+}
+
+func WithSynchronous(mode SynchronousMode) OpenOption {
+	return func(options *openOptions) {
+		options.params.Set("_synchronous", string(mode))
+	}
+}
+
+func WithForeignKeys() OpenOption {
+	return func(options *openOptions) {
+		options.params.Set("_foreign_keys", "1")
+	}
+}
+
+// As PRAGMA cache_size, positive sizes are pages and negative sizes are KiB
+func WithCacheSize(size int) OpenOption {
+	return func(options *openOptions) {
+		options.params.Set("_cache_size", fmt.Sprint(size))
+	}
+}
+
+// Memory maps up to size bytes of the database file, 0 disables it
+func WithMmap(size int64) OpenOption {
+	return func(options *openOptions) {
+		if size < 0 {
+			options.err = errors.New("mmap size cannot be negative")
+			return
+		}
+
+		options.pragmas = append(options.pragmas, fmt.Sprintf("PRAGMA mmap_size = %d", size))
+	}
+}
+
+var defaultOpenOptions = []OpenOption{}
+
+// Options used by every OpenDB call, including those made by the package-level functions, KV store and watchers.
+// Options passed to OpenDB are applied after these.
+func SetDefaultOpenOptions(options ...OpenOption) {
+	defaultOpenOptions = options
+}
+
+func applyOpenOptions(options []OpenOption) (openOptions, error) {
+	applied := openOptions{params: url.Values{}}
+
+	for _, option := range append(slices.Clip(defaultOpenOptions), options...) {
+		option(&applied)
+
+		if applied.err != nil {
+			return applied, applied.err
+		}
+	}
+
+	return applied, nil
+}
+
+// The path with the options' parameters added to any it already has
+func (options openOptions) dsn(dbPath string) string {
+	if len(options.params) == 0 {
+		return dbPath
+	}
+
+	if strings.Contains(dbPath, "?") {
+		return dbPath + "&" + options.params.Encode()
+	}
+
+	return dbPath + "?" + options.params.Encode()
+}
+
+// Opens connections with the dbdt driver, running pragmas on each one and publishing its commits
+type dbConnector struct {
+	path      string // As passed to OpenDB, OpenReadOnly or OpenMemory, so the database can be opened again
+	dsn       string
+	pragmas   []string
+	readOnly  bool        // Translate write errors to ErrReadOnly
+	keepAlive driver.Conn // Held until the database is closed, keeping an in-memory database alive
+}
+
+func (connector dbConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := dbDriver.Open(connector.dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pragma := range connector.pragmas {
+		_, err = conn.(driver.ExecerContext).ExecContext(ctx, pragma, nil)
+
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return dbConn{conn, watchCommits(sqliteConn(conn)), connector.readOnly, connector.path}, nil
+}
+
+func (connector dbConnector) Driver() driver.Driver {
+	return dbDriver
+}
+
+// Called by sql.DB.Close
+func (connector dbConnector) Close() error {
+	if connector.keepAlive == nil {
+		return nil
+	}
+
+	return connector.keepAlive.Close()
+}
+
+func openDB(dbPath string, options []OpenOption) (*sql.DB, error) {
+	applied, err := applyOpenOptions(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sql.OpenDB(dbConnector{path: dbPath, dsn: applied.dsn(dbPath), pragmas: applied.pragmas}), nil
+}
@@ -3,41 +3,255 @@ package dbdt
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type DBWatcher struct {
+	db          *sql.DB
 	conn        *sql.Conn
 	dataVersion int
 
-	Callbacks []func()
+	lock      sync.Mutex
+	stop      chan struct{} // Nil while not polling
+	done      chan struct{} // Closed when the polling goroutine exits
+	closed    bool
+	stopAfter func() bool // Unregisters the context's close, if there is one
+	options   watcherOptions
+
+	callbackLock sync.Mutex
+	callbacks    []*watcherCallback // Replaced rather than modified, so the poller can run a snapshot without the lock
+
+	events       chan Event
+	errors       chan error
+	eventsWanted atomic.Bool
+	errorsWanted atomic.Bool
+
+	file               string        // As reported by SQLite, to match in-process commits
+	wake               chan struct{} // Signalled by in-process commits and file notifications, so changes are seen without waiting to poll
+	unsubscribeCommits func()
+	notifier           *fileNotifier // Nil while polling, its done channel closes if notifications stop
+}
+
+type watcherCallback struct {
+	callback     func()
+	tables       []string         // Nil runs the callback on any change
+	versions     map[string]int64 // The last seen version of each table, only used by the polling goroutine
+	unsubscribed atomic.Bool
+}
+
+type WatcherOption func(*watcherOptions)
+
+type watcherOptions struct {
+	pollInterval time.Duration
+	maxInterval  time.Duration
+	debounce     time.Duration
+	eventBuffer  int
+	overflow     OverflowPolicy
+	notify       bool
+}
+
+// How often data_version is checked, 10ms by default
+func WithPollInterval(interval time.Duration) WatcherOption {
+	return func(options *watcherOptions) {
+		options.pollInterval = interval
+	}
+}
+
+// While nothing changes, the poll interval doubles each time up to maxInterval. It drops back after a change.
+func WithBackoff(maxInterval time.Duration) WatcherOption {
+	return func(options *watcherOptions) {
+		options.maxInterval = maxInterval
+	}
+}
+
+// Callbacks run once, window after the first change is seen, so a burst of writes within the window causes one call
+func WithDebounce(window time.Duration) WatcherOption {
+	return func(options *watcherOptions) {
+		options.debounce = window
+	}
+}
+
+// On Linux, waits for inotify events on the database files instead of polling while idle. After an event,
+// data_version is checked as usual. Events can be missed, on network filesystems for instance, so an idle watcher
+// still polls every second, or at the WithBackoff interval if that is longer. If the notifications stop, the watcher
+// reports an error and polls as usual. Elsewhere, or if inotify is unavailable, the watcher polls.
+func WithFileNotifications() WatcherOption {
+	return func(options *watcherOptions) {
+		options.notify = true
+	}
+}
+
+// How often a watcher with file notifications polls while idle, unless WithBackoff allows longer
+const notifySafetyInterval = time.Second
+
+func applyWatcherOptions(options []WatcherOption) (watcherOptions, error) {
+	applied := watcherOptions{pollInterval: time.Millisecond * 10, eventBuffer: 16}
+
+	for _, option := range options {
+		option(&applied)
+	}
+
+	if applied.pollInterval <= 0 {
+		return applied, errors.New("poll interval must be positive")
+	}
+
+	if applied.debounce < 0 {
+		return applied, errors.New("debounce window cannot be negative")
+	}
+
+	if applied.eventBuffer < 0 || (applied.eventBuffer == 0 && applied.overflow == DropOldest) {
+		return applied, errors.New("event buffer is too small")
+	}
+
+	applied.maxInterval = max(applied.maxInterval, applied.pollInterval)
+
+	return applied, nil
+}
+
+func CreateDBWatcher(dbPath string, options ...WatcherOption) (*DBWatcher, error) {
+	return CreateDBWatcherContext(context.Background(), dbPath, options...)
 }
 
-func CreateDBWatcher(dbPath string) (*DBWatcher, error) {
+// As CreateDBWatcher, but the watcher is closed when ctx is done
+func CreateDBWatcherContext(ctx context.Context, dbPath string, options ...WatcherOption) (*DBWatcher, error) {
+	applied, err := applyWatcherOptions(options)
+
+	if err != nil {
+		return nil, err
+	}
+
 	db, err := OpenDB(dbPath)
 
 	if err != nil {
 		return nil, err
 	}
 
-	ctx := context.Background()
 	conn, err := db.Conn(ctx)
 
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	watcher := DBWatcher{conn, 0, []func(){}}
+	file, err := GetSingleDB[string](db, "SELECT file FROM pragma_database_list WHERE name = 'main'")
+
+	if err != nil {
+		conn.Close()
+		db.Close()
+		return nil, err
+	}
+
+	watcher := DBWatcher{
+		db:      db,
+		conn:    conn,
+		options: applied,
+		events:  make(chan Event, applied.eventBuffer),
+		errors:  make(chan error, max(applied.eventBuffer, 1)),
+		file:    file,
+		wake:    make(chan struct{}, 1),
+	}
+
+	watcher.unsubscribeCommits = SubscribeCommits(watcher.commitMade)
+
+	if applied.notify && file != "" {
+		watcher.notifier, err = watchFileChanges(file, watcher.wake)
+
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			watcher.reportError(fmt.Errorf("file notifications unavailable, polling instead, %w", err))
+		}
+	}
 
 	watcher.checkDataVersion()
 
 	watcher.Start()
 
+	// Close reads stopAfter, and runs as soon as the context is done, which may already be the case
+	watcher.lock.Lock()
+	watcher.stopAfter = context.AfterFunc(ctx, func() { watcher.Close() })
+	watcher.lock.Unlock()
+
 	return &watcher, nil
 }
 
-func (watcher *DBWatcher) AddCallback(callback func()) {
-	watcher.Callbacks = append(watcher.Callbacks, callback)
+func (watcher *DBWatcher) commitMade(changes []RowChange) {
+	if !slices.ContainsFunc(changes, func(change RowChange) bool { return change.Database == watcher.file }) {
+		return
+	}
+
+	select {
+	case watcher.wake <- struct{}{}:
+	default: // Already woken
+	}
+}
+
+// Callbacks run in the order they were added, on the watcher's goroutine. A panicking callback is reported
+// through Errors and does not stop the others. Unsubscribing prevents later calls, though a call already running will finish.
+func (watcher *DBWatcher) AddCallback(callback func()) (unsubscribe func()) {
+	return watcher.subscribe(&watcherCallback{callback: callback})
+}
+
+func (watcher *DBWatcher) subscribe(entry *watcherCallback) (unsubscribe func()) {
+	watcher.callbackLock.Lock()
+	watcher.callbacks = append(slices.Clip(watcher.callbacks), entry)
+	watcher.callbackLock.Unlock()
+
+	return func() {
+		entry.unsubscribed.Store(true)
+
+		watcher.callbackLock.Lock()
+		defer watcher.callbackLock.Unlock()
+
+		watcher.callbacks = slices.DeleteFunc(slices.Clone(watcher.callbacks), func(other *watcherCallback) bool {
+			return other == entry
+		})
+	}
+}
+
+func (watcher *DBWatcher) runCallbacks() {
+	callbacks := watcher.snapshotCallbacks()
+	versions := watcher.tableVersions(callbacks)
+
+	for _, entry := range callbacks {
+		if entry.unsubscribed.Load() || !entry.tablesChanged(versions) {
+			continue
+		}
+
+		watcher.runCallback(entry.callback)
+	}
+}
+
+// Records the current table versions without running callbacks, so changes made by callbacks are not reported
+func (watcher *DBWatcher) skipCallbacks() {
+	callbacks := watcher.snapshotCallbacks()
+	versions := watcher.tableVersions(callbacks)
+
+	for _, entry := range callbacks {
+		entry.tablesChanged(versions)
+	}
+}
+
+func (watcher *DBWatcher) snapshotCallbacks() []*watcherCallback {
+	watcher.callbackLock.Lock()
+	defer watcher.callbackLock.Unlock()
+
+	return watcher.callbacks
+}
+
+func (watcher *DBWatcher) runCallback(callback func()) {
+	defer func() {
+		r := recover()
+
+		if r != nil {
+			watcher.reportPanic(r)
+		}
+	}()
+
+	callback()
 }
 
 // True if the database has been updated
@@ -46,11 +260,12 @@ func (watcher *DBWatcher) checkDataVersion() bool {
 
 	row := watcher.conn.QueryRowContext(context.Background(), query)
 
-	dataVersion := -1
+	dataVersion := 0
 
-	row.Scan(&dataVersion)
+	err := row.Scan(&dataVersion)
 
-	if dataVersion == -1 {
+	if err != nil {
+		watcher.reportError(err)
 		return false
 	}
 
@@ -62,21 +277,157 @@ func (watcher *DBWatcher) checkDataVersion() bool {
 	return false
 }
 
+// Starts polling for changes, CreateDBWatcher does this already. Does nothing if the watcher is polling or closed.
 func (watcher *DBWatcher) Start() {
-	go func() {
-		for {
-			time.Sleep(time.Millisecond * 10)
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
 
-			if watcher.checkDataVersion() {
+	if watcher.closed || watcher.stop != nil {
+		return
+	}
+
+	watcher.stop = make(chan struct{})
+	watcher.done = make(chan struct{})
+
+	go watcher.poll(watcher.stop, watcher.done)
+}
 
-				// Execute all callbacks
-				for _, callback := range watcher.Callbacks {
-					callback()
-				}
+func (watcher *DBWatcher) poll(stop chan struct{}, done chan struct{}) {
+	defer close(done)
 
-				// Check the data version again, callbacks may have changed DB
-				watcher.checkDataVersion()
+	interval := watcher.options.pollInterval
+	maxInterval := watcher.options.maxInterval
+	notifierStopped := (chan struct{})(nil)
+
+	if watcher.notifier != nil {
+		maxInterval = max(maxInterval, notifySafetyInterval)
+		notifierStopped = watcher.notifier.done
+	}
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		woken := false
+
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		case <-watcher.wake:
+			woken = true
+		case <-notifierStopped:
+			watcher.reportError(errors.New("file notifications stopped, polling instead"))
+			notifierStopped = nil
+			maxInterval = watcher.options.maxInterval
+			woken = true
+		}
+
+		if !watcher.checkDataVersion() {
+			if woken {
+				// File notifications can come just before the commit completes, so check again shortly
+				interval = min(time.Millisecond, watcher.options.pollInterval)
+			} else {
+				interval = min(interval*2, maxInterval)
 			}
+
+			timer.Reset(interval)
+			continue
 		}
-	}()
+
+		if watcher.options.debounce > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(watcher.options.debounce):
+			}
+
+			// Changes made during the window are covered by this call
+			watcher.checkDataVersion()
+		}
+
+		if !watcher.sendEvent(stop, Event{watcher.dataVersion, time.Now()}) {
+			return
+		}
+
+		watcher.runCallbacks()
+
+		// Check the data version again, callbacks may have changed DB
+		if watcher.checkDataVersion() {
+			watcher.skipCallbacks()
+		}
+
+		interval = watcher.options.pollInterval
+		timer.Reset(interval)
+	}
+}
+
+// True if the watcher waits for file notifications rather than polling, see WithFileNotifications
+func (watcher *DBWatcher) FileNotifications() bool {
+	if watcher.notifier == nil {
+		return false
+	}
+
+	select {
+	case <-watcher.notifier.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Stops polling, waiting for any running callbacks to return, so it must not be called from a callback.
+// Start resumes polling.
+func (watcher *DBWatcher) Stop() {
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+
+	watcher.stopLocked()
+}
+
+func (watcher *DBWatcher) stopLocked() {
+	if watcher.stop == nil {
+		return
+	}
+
+	close(watcher.stop)
+	<-watcher.done
+
+	watcher.stop = nil
+	watcher.done = nil
+}
+
+// Stops polling and releases the connection, the watcher cannot be restarted. Like Stop, it must not be called from a callback.
+func (watcher *DBWatcher) Close() error {
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+
+	if watcher.closed {
+		return nil
+	}
+
+	watcher.closed = true
+	watcher.unsubscribeCommits()
+	watcher.stopLocked()
+
+	if watcher.notifier != nil {
+		watcher.notifier.Close()
+	}
+
+	if watcher.stopAfter != nil {
+		watcher.stopAfter()
+	}
+
+	// Only the polling goroutine sends, so the channels can be closed once it has stopped
+	close(watcher.events)
+	close(watcher.errors)
+
+	err := watcher.conn.Close()
+
+	if err != nil {
+		watcher.db.Close()
+		return err
+	}
+
+	return watcher.db.Close()
 }
@@ -0,0 +1,97 @@
+package dbdt
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+type Event struct {
+	DataVersion int
+	Time        time.Time // When the change was seen
+}
+
+type OverflowPolicy int
+
+const (
+	DropOldest OverflowPolicy = iota // The oldest unread event is discarded to make room
+	Block                            // Polling and callbacks wait until the event is read
+)
+
+// The number of events buffered for Events, 16 by default. DropOldest needs a buffer of at least 1.
+func WithEventBuffer(size int) WatcherOption {
+	return func(options *watcherOptions) {
+		options.eventBuffer = size
+	}
+}
+
+// What happens when the Events buffer is full, DropOldest by default
+func WithOverflow(policy OverflowPolicy) WatcherOption {
+	return func(options *watcherOptions) {
+		options.overflow = policy
+	}
+}
+
+// Receives an Event each time the callbacks would run. Events are only sent after the first call,
+// so a watcher used only through callbacks never fills the buffer. The channel is closed by Close.
+func (watcher *DBWatcher) Events() <-chan Event {
+	watcher.eventsWanted.Store(true)
+
+	return watcher.events
+}
+
+// Receives errors reading the database and callback panics, which are logged until this is first called.
+// When the buffer is full the oldest error is discarded. The channel is closed by Close.
+func (watcher *DBWatcher) Errors() <-chan error {
+	watcher.errorsWanted.Store(true)
+
+	return watcher.errors
+}
+
+// Returns false if the watcher was stopped while blocked on a full buffer
+func (watcher *DBWatcher) sendEvent(stop chan struct{}, event Event) bool {
+	if !watcher.eventsWanted.Load() {
+		return true
+	}
+
+	if watcher.options.overflow == Block {
+		select {
+		case watcher.events <- event:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	sendDroppingOldest(watcher.events, event)
+
+	return true
+}
+
+func sendDroppingOldest[V any](channel chan V, value V) {
+	for {
+		select {
+		case channel <- value:
+			return
+		default:
+		}
+
+		select {
+		case <-channel:
+		default:
+		}
+	}
+}
+
+func (watcher *DBWatcher) reportError(err error) {
+	if !watcher.errorsWanted.Load() {
+		log.Printf("DBWatcher error, %v", err)
+		return
+	}
+
+	sendDroppingOldest(watcher.errors, err)
+}
+
+func (watcher *DBWatcher) reportPanic(r any) {
+	watcher.reportError(fmt.Errorf("callback panicked, %v", r))
+}
@@ -0,0 +1,84 @@
+package dbdt
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Signals wake whenever the database file, or its -wal or -journal file, is written, created or removed.
+// The directory is watched, since the -wal and -journal files come and go. done is closed if reading stops.
+type fileNotifier struct {
+	file *os.File
+	done chan struct{}
+}
+
+func watchFileChanges(dbPath string, wake chan struct{}) (*fileNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mask := uint32(syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_TO)
+
+	_, err = syscall.InotifyAddWatch(fd, filepath.Dir(dbPath), mask)
+
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// Non-blocking, so reads go through the runtime poller and Close interrupts them
+	notifier := &fileNotifier{os.NewFile(uintptr(fd), "inotify"), make(chan struct{})}
+
+	go notifier.read(filepath.Base(dbPath), wake)
+
+	return notifier, nil
+}
+
+func (notifier *fileNotifier) read(name string, wake chan struct{}) {
+	defer close(notifier.done)
+
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := notifier.file.Read(buffer)
+
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			// Each event is wd, mask, cookie and len, followed by len bytes of NUL padded name
+			mask := binary.NativeEndian.Uint32(buffer[offset+4:])
+			nameLength := int(binary.NativeEndian.Uint32(buffer[offset+12:]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			eventName := strings.TrimRight(string(buffer[nameStart:nameStart+nameLength]), "\x00")
+
+			offset = nameStart + nameLength
+
+			// The directory was removed or unmounted, no more events will come
+			if mask&syscall.IN_IGNORED != 0 {
+				return
+			}
+
+			// After an overflow, events for the database may have been dropped
+			if mask&syscall.IN_Q_OVERFLOW != 0 || eventName == name || eventName == name+"-wal" || eventName == name+"-journal" {
+				select {
+				case wake <- struct{}{}:
+				default: // Already woken
+				}
+			}
+		}
+	}
+}
+
+func (notifier *fileNotifier) Close() error {
+	err := notifier.file.Close()
+	<-notifier.done
+
+	return err
+}
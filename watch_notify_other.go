@@ -0,0 +1,18 @@
+//go:build !linux
+
+package dbdt
+
+import "errors"
+
+// File notifications use inotify, elsewhere watchers poll
+type fileNotifier struct {
+	done chan struct{}
+}
+
+func watchFileChanges(dbPath string, wake chan struct{}) (*fileNotifier, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (notifier *fileNotifier) Close() error {
+	return nil
+}
@@ -0,0 +1,146 @@
+package dbdt
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// Triggers on watched tables bump the table's version here on every row change. The triggers are kept
+// in the database, so writes from every process (including those not using dbdt) are counted.
+const createTableVersions = `CREATE TABLE IF NOT EXISTS __dbdt_table_versions (
+	table_name TEXT PRIMARY KEY,
+	version INTEGER NOT NULL
+)`
+
+func tableVersionTrigger(tableName string, event string) string {
+	return fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS "__dbdt_%[1]s_%[2]s" AFTER %[2]s ON "%[1]s"
+		BEGIN
+			INSERT INTO __dbdt_table_versions (table_name, version) VALUES ('%[1]s', 1)
+			ON CONFLICT (table_name) DO UPDATE SET version = version + 1;
+		END`,
+		tableName, event)
+}
+
+func installTableVersionTriggers(db DBTX, tableName string) error {
+	if !identifierPattern.MatchString(tableName) {
+		return fmt.Errorf("cannot watch table %q", tableName)
+	}
+
+	queries := []string{
+		createTableVersions,
+		tableVersionTrigger(tableName, "INSERT"),
+		tableVersionTrigger(tableName, "UPDATE"),
+		tableVersionTrigger(tableName, "DELETE"),
+	}
+
+	for _, query := range queries {
+		err := ExecDB(db, query)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Runs callback only when rows in one of the tables are inserted, updated or deleted
+func (watcher *DBWatcher) WatchTables(callback func(), tables ...string) (unsubscribe func(), err error) {
+	if len(tables) == 0 {
+		return nil, errors.New("no tables to watch")
+	}
+
+	for _, table := range tables {
+		err = installTableVersionTriggers(watcher.db, table)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	versions, err := readTableVersions(watcher.db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &watcherCallback{callback: callback, tables: slices.Clone(tables), versions: map[string]int64{}}
+
+	for _, table := range tables {
+		entry.versions[table] = versions[table]
+	}
+
+	return watcher.subscribe(entry), nil
+}
+
+// Runs callback only when rows in T's table are inserted, updated or deleted
+func WatchTable[T any](watcher *DBWatcher, callback func()) (unsubscribe func(), err error) {
+	return watcher.WatchTables(callback, GetTableName(reflect.TypeFor[T]()))
+}
+
+func readTableVersions(db DBTX) (map[string]int64, error) {
+	rows, err := db.Query("SELECT table_name, version FROM __dbdt_table_versions")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	versions := map[string]int64{}
+
+	for rows.Next() {
+		table := ""
+		version := int64(0)
+
+		err = rows.Scan(&table, &version)
+
+		if err != nil {
+			return nil, err
+		}
+
+		versions[table] = version
+	}
+
+	return versions, rows.Err()
+}
+
+// Nil if no callback watches tables. If the versions cannot be read, every table callback runs.
+func (watcher *DBWatcher) tableVersions(callbacks []*watcherCallback) map[string]int64 {
+	watchesTables := slices.ContainsFunc(callbacks, func(entry *watcherCallback) bool {
+		return entry.tables != nil
+	})
+
+	if !watchesTables {
+		return nil
+	}
+
+	versions, err := readTableVersions(watcher.db)
+
+	if err != nil {
+		watcher.reportError(fmt.Errorf("could not read table versions, %w", err))
+		return nil
+	}
+
+	return versions
+}
+
+// Records the latest versions, returning true if any of the entry's tables changed
+func (entry *watcherCallback) tablesChanged(versions map[string]int64) bool {
+	if entry.tables == nil || versions == nil {
+		return true
+	}
+
+	changed := false
+
+	for _, table := range entry.tables {
+		if versions[table] != entry.versions[table] {
+			entry.versions[table] = versions[table]
+			changed = true
+		}
+	}
+
+	return changed
+}